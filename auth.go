@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"math"
@@ -16,6 +17,16 @@ import (
 
 type Auth struct {
 	Mechanisms map[string]AuthExtension
+
+	// mechanisms that were registered as usable without TLS
+	cleartext map[string]bool
+}
+
+// AuthOptions adjust how a single registered mechanism is offered
+type AuthOptions struct {
+	// RequireTLS refuses the mechanism on connections that haven't negotiated TLS.
+	// Mechanisms added with Extend always require it
+	RequireTLS bool
 }
 
 func NewAuth() *Auth {
@@ -35,16 +46,19 @@ func (a *Auth) Handle(c *Conn, args string) error {
 			args = mech[1]
 		}
 
+		c.tlsExempt = a.cleartext[strings.ToUpper(mech[0])]
 		user, err := m.Handle(c, args)
+		c.tlsExempt = false
 		if err != nil {
 			return err
 		}
 
 		c.User = user
+		c.AuthMechanism = strings.ToUpper(mech[0])
 		return nil
 	}
 
-	return &SMTPError{500, fmt.Errorf("AUTH mechanism %v not available", mech[0])}
+	return &SMTPError{Code: 500, Err: fmt.Errorf("AUTH mechanism %v not available", mech[0]), Enhanced: "5.5.4"}
 
 }
 
@@ -59,11 +73,23 @@ func (a *Auth) EHLO() string {
 
 // Extend the auth handler by adding a new mechanism
 func (a *Auth) Extend(mechanism string, extension AuthExtension) error {
+	return a.ExtendWithOptions(mechanism, extension, AuthOptions{RequireTLS: true})
+}
+
+// ExtendWithOptions adds a new mechanism like Extend, with per-mechanism options,
+// e.g. allowing PLAIN over cleartext on a trusted internal network
+func (a *Auth) ExtendWithOptions(mechanism string, extension AuthExtension, opts AuthOptions) error {
 	mechanism = strings.ToUpper(mechanism)
 	if _, ok := a.Mechanisms[mechanism]; ok {
 		return fmt.Errorf("AUTH mechanism %v is already implemented", mechanism)
 	}
 	a.Mechanisms[mechanism] = extension
+	if !opts.RequireTLS {
+		if a.cleartext == nil {
+			a.cleartext = make(map[string]bool)
+		}
+		a.cleartext[mechanism] = true
+	}
 	return nil
 }
 
@@ -102,7 +128,7 @@ func (a *AuthPlain) unpack(line string) (string, string, error) {
 // Handles the negotiation of an AUTH PLAIN request
 func (a *AuthPlain) Handle(conn *Conn, params string) (AuthUser, error) {
 
-	if !conn.IsTLS {
+	if !conn.IsTLS && !conn.tlsExempt {
 		return nil, ErrRequiresTLS
 	}
 
@@ -127,14 +153,125 @@ func (a *AuthPlain) Handle(conn *Conn, params string) (AuthUser, error) {
 	return nil, ErrAuthFailed
 }
 
+type AuthLogin struct {
+	Auth SimpleAuthFunc
+}
+
+// prompt sends a base64 encoded challenge and reads back the decoded response
+func (a *AuthLogin) prompt(conn *Conn, challenge string) (string, error) {
+	conn.WriteSMTP(334, base64.StdEncoding.EncodeToString([]byte(challenge)))
+	line, err := conn.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return a.decode(line)
+}
+
+func (a *AuthLogin) decode(line string) (string, error) {
+	if strings.TrimSpace(line) == "*" {
+		return "", ErrAuthCancelled
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// Handles the negotiation of an AUTH LOGIN request, the username may be sent along with
+// the command rather than waiting to be prompted for it
+// https://tools.ietf.org/html/draft-murchison-sasl-login-00
+func (a *AuthLogin) Handle(conn *Conn, params string) (AuthUser, error) {
+
+	if !conn.IsTLS && !conn.tlsExempt {
+		return nil, ErrRequiresTLS
+	}
+
+	var username string
+	var err error
+	if strings.TrimSpace(params) == "" {
+		username, err = a.prompt(conn, "Username:")
+	} else {
+		username, err = a.decode(params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := a.prompt(conn, "Password:")
+	if err != nil {
+		return nil, err
+	}
+
+	if user, isAuth := a.Auth(username, password); isAuth {
+		return user, nil
+	}
+
+	return nil, ErrAuthFailed
+}
+
+// AuthExternal authenticates clients by the certificate they presented during the TLS
+// handshake, FindUser is given the verified certificate (see its Subject, DNSNames &
+// EmailAddresses) and the authorization identity requested by the client, if any
+type AuthExternal struct {
+	FindUser func(cert *x509.Certificate, identity string) (AuthUser, error)
+}
+
+// Handles the negotiation of an AUTH EXTERNAL request, the identity may be sent along
+// with the command, or after an empty challenge. "=" stands for an empty identity
+// https://tools.ietf.org/html/rfc4422#appendix-A
+func (a *AuthExternal) Handle(conn *Conn, params string) (AuthUser, error) {
+
+	state, ok := conn.ConnectionState()
+	if !ok {
+		return nil, ErrRequiresTLS
+	}
+
+	line := strings.TrimSpace(params)
+	if line == "" {
+		conn.WriteSMTP(334, "")
+		var err error
+		if line, err = conn.ReadLine(); err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+	}
+
+	var identity string
+	switch line {
+	case "*":
+		return nil, ErrAuthCancelled
+	case "=", "":
+	default:
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		identity = string(decoded)
+	}
+
+	// without a verified client certificate there's nothing to authenticate with. Under
+	// tls.RequestClientCert & RequireAnyClientCert the peer's certificates aren't checked
+	// at all, so only a verified chain counts
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 || a.FindUser == nil {
+		return nil, ErrAuthFailed
+	}
+
+	user, err := a.FindUser(state.VerifiedChains[0][0], identity)
+	if err != nil || user == nil {
+		return nil, ErrAuthFailed
+	}
+	return user, nil
+}
+
 type AuthCramMd5 struct {
 	FindUser func(string) (AuthUser, error)
 }
 
 // challenge generates a CramMD5 challenge using the http://www.jwz.org/doc/mid.html recommendation
-func (a *AuthCramMd5) challenge() []byte {
+func (a *AuthCramMd5) challenge(now time.Time) []byte {
 
-	wallTime := time.Now().Unix()
+	wallTime := now.Unix()
 	randValue, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
 		panic(err)
@@ -182,11 +319,11 @@ func (a *AuthCramMd5) CheckResponse(response string, challenge []byte) (AuthUser
 // http://www.samlogic.net/articles/smtp-commands-reference-auth.htm
 func (a *AuthCramMd5) Handle(conn *Conn, params string) (AuthUser, error) {
 
-	if !conn.IsTLS {
+	if !conn.IsTLS && !conn.tlsExempt {
 		return nil, ErrRequiresTLS
 	}
 
-	myChallenge := a.challenge()
+	myChallenge := a.challenge(conn.now())
 	conn.WriteSMTP(334, base64.StdEncoding.EncodeToString(myChallenge))
 	if line, err := conn.ReadLine(); err == nil {
 		if strings.TrimSpace(line) == "*" {
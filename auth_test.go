@@ -1,8 +1,16 @@
 package smtpd_test
 
 import (
+    "bytes"
     "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "fmt"
+    "log"
+    "net"
     "net/smtp"
+    "net/textproto"
+    "strings"
     "testing"
     "time"
 
@@ -22,6 +30,10 @@ func (t *TestUser) Password() string {
     return t.password
 }
 
+func (t *TestUser) String() string {
+    return t.username
+}
+
 func TestSMTPAuthPlain(t *testing.T) {
     recorder := &MessageRecorder{}
     server := smtpd.NewServer(recorder.Record)
@@ -213,3 +225,932 @@ func TestSMTPAuthCramMd5(t *testing.T) {
         t.Errorf("Auth should have succeeded: %v", err)
     }
 }
+
+func TestSMTPAuthOnAuthSuccess(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+    server.MaxSize = 2048
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, true
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    // VIPs get to send bigger messages
+    server.OnAuthSuccess = func(conn *smtpd.Conn, user smtpd.AuthUser) {
+        if user.(*TestUser).username == "vip@example.com" {
+            conn.MaxSize = 1 << 20
+        }
+    }
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    send := func(username string) error {
+        c, err := smtp.Dial(server.Address())
+        if err != nil {
+            return err
+        }
+        defer c.Close()
+
+        if err := c.StartTLS(&tls.Config{ServerName: server.Name, InsecureSkipVerify: true}); err != nil {
+            return err
+        }
+        if err := c.Auth(smtp.PlainAuth("", username, "password", "127.0.0.1")); err != nil {
+            return err
+        }
+        if err := c.Mail(username); err != nil {
+            return err
+        }
+        if err := c.Rcpt("recipient@example.net"); err != nil {
+            return err
+        }
+        wc, err := c.Data()
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(wc, "From: %v\nTo: recipient@example.net\n\n%v", username, strings.Repeat("big message\n", 1024))
+        return wc.Close()
+    }
+
+    if err := send("vip@example.com"); err != nil {
+        t.Errorf("Large message should be accepted after OnAuthSuccess raised the limit: %v", err)
+    }
+
+    if err := send("user@example.com"); err == nil {
+        t.Errorf("Large message should be refused without a raised limit")
+    }
+
+    if len(recorder.Messages) != 1 {
+        t.Errorf("Expected 1 message, got: %v", len(recorder.Messages))
+    }
+}
+
+func TestSMTPAuthAttemptsSpanMechanisms(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+    server.MaxAuthAttempts = 3
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return nil, false
+        },
+    })
+    serverAuth.Extend("CRAM-MD5", &smtpd.AuthCramMd5{
+        FindUser: func(username string) (smtpd.AuthUser, error) {
+            return &TestUser{username, "password"}, nil
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+
+    badPlain := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00wrong"))
+
+    // alternate mechanisms, none of which should reset the count
+    c.PrintfLine("AUTH PLAIN %v", badPlain)
+    if code, _, _ := c.ReadResponse(235); code == 235 || code == 421 {
+        t.Fatalf("Expected the first attempt to fail without disconnecting, got: %v", code)
+    }
+
+    c.PrintfLine("AUTH CRAM-MD5")
+    if _, _, err := c.ReadResponse(334); err != nil {
+        t.Fatalf("Expected a CRAM-MD5 challenge: %v", err)
+    }
+    c.PrintfLine("%v", base64.StdEncoding.EncodeToString([]byte("user@example.com wrong")))
+    if code, _, _ := c.ReadResponse(235); code == 235 || code == 421 {
+        t.Fatalf("Expected the second attempt to fail without disconnecting, got: %v", code)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", badPlain)
+    if _, _, err := c.ReadResponse(421); err != nil {
+        t.Fatalf("Expected to be disconnected at the attempt cap: %v", err)
+    }
+
+    c.PrintfLine("NOOP")
+    if _, _, err := c.ReadResponse(250); err == nil {
+        t.Error("Expected the connection to be closed")
+    }
+}
+
+func TestSMTPAuthRequiredResponse(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{}, true
+        },
+    })
+
+    server.Auth = serverAuth
+    server.AuthRequiredResponse = smtpd.NewError(530, "5.7.0 Authentication required, see https://example.com/help")
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    c, err := textproto.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer c.Close()
+
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("MAIL FROM:<sender@example.org>")
+    if _, msg, err := c.ReadResponse(530); err != nil {
+        t.Errorf("Should not be able to set a sender before Authenticating: %v", err)
+    } else if msg != server.AuthRequiredResponse.Error() {
+        t.Errorf("Wrong response, want: %v, got: %v", server.AuthRequiredResponse.Error(), msg)
+    }
+}
+
+func TestSMTPAuthUsedExtensions(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, true
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+
+    c.PrintfLine("EHLO localhost")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+    if _, _, err := c.ReadResponse(235); err != nil {
+        t.Fatalf("Auth should have succeeded: %v", err)
+    }
+
+    c.PrintfLine("MAIL FROM:<user@example.com> SIZE=100")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("Should be able to set a sender: %v", err)
+    }
+    c.PrintfLine("RCPT TO:<recipient@example.net>")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("Should be able to set a RCPT: %v", err)
+    }
+    c.PrintfLine("DATA")
+    if _, _, err := c.ReadResponse(354); err != nil {
+        t.Fatalf("Should be able to start DATA: %v", err)
+    }
+
+    w := c.DotWriter()
+    fmt.Fprint(w, "From: user@example.com\nTo: recipient@example.net\n\nThis is the email body")
+    w.Close()
+
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("Message should have been accepted: %v", err)
+    }
+
+    if len(recorder.Messages) != 1 {
+        t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+    }
+
+    used := strings.Join(recorder.Messages[0].UsedExtensions, ",")
+    if used != "STARTTLS,AUTH PLAIN,SIZE" {
+        t.Errorf("Wrong used extensions, want: STARTTLS,AUTH PLAIN,SIZE, got: %v", used)
+    }
+}
+
+func TestSMTPAuthConnInfo(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, true
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+    c = textproto.NewConn(tlsConn)
+
+    c.PrintfLine("EHLO localhost")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+    if _, _, err := c.ReadResponse(235); err != nil {
+        t.Fatalf("Auth should have succeeded: %v", err)
+    }
+
+    c.PrintfLine("MAIL FROM:<user@example.com>")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("Should be able to set a sender: %v", err)
+    }
+    c.PrintfLine("RCPT TO:<recipient@example.net>")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("Should be able to set a RCPT: %v", err)
+    }
+    c.PrintfLine("DATA")
+    if _, _, err := c.ReadResponse(354); err != nil {
+        t.Fatalf("Should be able to start DATA: %v", err)
+    }
+
+    w := c.DotWriter()
+    fmt.Fprint(w, "From: user@example.com\nTo: recipient@example.net\n\nThis is the email body")
+    w.Close()
+
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("Message should have been accepted: %v", err)
+    }
+
+    if len(recorder.Messages) != 1 {
+        t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+    }
+
+    info := recorder.Messages[0].ConnInfo
+    if info.RemoteAddr.String() != conn.LocalAddr().String() {
+        t.Errorf("Wrong remote address, want: %v, got: %v", conn.LocalAddr(), info.RemoteAddr)
+    }
+    if info.LocalAddr.String() != server.Address() {
+        t.Errorf("Wrong local address, want: %v, got: %v", server.Address(), info.LocalAddr)
+    }
+    if !info.TLS || info.TLSVersion != tls.VersionTLS12 {
+        t.Errorf("Expected a TLS 1.2 connection, got: %v %x", info.TLS, info.TLSVersion)
+    }
+    if info.User != "user@example.com" {
+        t.Errorf("Wrong user, want: user@example.com, got: %v", info.User)
+    }
+}
+
+func TestSMTPAuthEnhancedStatusCodes(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, password == "password"
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+    server.EnhancedStatusCodes = true
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+
+    c.PrintfLine("EHLO localhost")
+    if _, msg, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    } else if !strings.Contains(msg, "ENHANCEDSTATUSCODES") {
+        t.Errorf("Expected ENHANCEDSTATUSCODES to be advertised, got: %v", msg)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00wrong")))
+    if _, msg, err := c.ReadResponse(535); err != nil {
+        t.Fatalf("Auth should have failed: %v", err)
+    } else if !strings.HasPrefix(msg, "5.7.8 ") {
+        t.Errorf("Expected a 5.7.8 enhanced code on failure, got: %v", msg)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+    if _, msg, err := c.ReadResponse(235); err != nil {
+        t.Fatalf("Auth should have succeeded: %v", err)
+    } else if !strings.HasPrefix(msg, "2.7.0 ") {
+        t.Errorf("Expected a 2.7.0 enhanced code on success, got: %v", msg)
+    }
+}
+
+type TokenAuth struct{}
+
+func (a *TokenAuth) Handle(conn *smtpd.Conn, params string) (smtpd.AuthUser, error) {
+    if params == "valid-token" {
+        return &TestUser{username: "token-user"}, nil
+    }
+    return nil, smtpd.ErrAuthFailed
+}
+
+func TestSMTPAuthMinTLSVersion(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, true
+        },
+    })
+    serverAuth.Extend("XTOKEN", &TokenAuth{})
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+    server.MinAuthTLSVersion = tls.VersionTLS13
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}))
+
+    c.PrintfLine("EHLO localhost")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+    if _, msg, err := c.ReadResponse(538); err != nil {
+        t.Fatalf("Password auth should have been refused over TLS 1.2: %v", err)
+    } else if msg != "Encryption too weak for requested authentication" {
+        t.Errorf("Wrong refusal, got: %v", msg)
+    }
+
+    c.PrintfLine("AUTH XTOKEN valid-token")
+    if _, _, err := c.ReadResponse(235); err != nil {
+        t.Fatalf("Token auth should have succeeded: %v", err)
+    }
+}
+
+func TestSMTPAuthLogin(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("LOGIN", &smtpd.AuthLogin{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, username == "user@example.com" && password == "password"
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("AUTH LOGIN")
+    if _, _, err := c.ReadResponse(538); err != nil {
+        t.Errorf("LOGIN should require TLS: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+
+    login := func(username, password string) (int, error) {
+        c.PrintfLine("AUTH LOGIN")
+        if _, msg, err := c.ReadResponse(334); err != nil {
+            return 0, err
+        } else if msg != "VXNlcm5hbWU6" {
+            t.Errorf("Wrong username prompt, got: %v", msg)
+        }
+
+        c.PrintfLine("%v", base64.StdEncoding.EncodeToString([]byte(username)))
+        if _, msg, err := c.ReadResponse(334); err != nil {
+            return 0, err
+        } else if msg != "UGFzc3dvcmQ6" {
+            t.Errorf("Wrong password prompt, got: %v", msg)
+        }
+
+        c.PrintfLine("%v", base64.StdEncoding.EncodeToString([]byte(password)))
+        code, _, err := c.ReadResponse(0)
+        return code, err
+    }
+
+    if code, err := login("user@example.com", "wrong"); err != nil || code != 535 {
+        t.Errorf("Expected a bad password to be refused, got: %v (%v)", code, err)
+    }
+
+    if code, err := login("user@example.com", "password"); err != nil || code != 235 {
+        t.Errorf("Expected LOGIN to succeed, got: %v (%v)", code, err)
+    }
+}
+
+func TestSMTPAuthExternal(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    clientCert := TestingClientCert("user@example.com")
+    pool := x509.NewCertPool()
+    pool.AddCert(clientCert.Leaf)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("EXTERNAL", &smtpd.AuthExternal{
+        FindUser: func(cert *x509.Certificate, identity string) (smtpd.AuthUser, error) {
+            if cert.Subject.CommonName != "user@example.com" || (identity != "" && identity != cert.Subject.CommonName) {
+                return nil, fmt.Errorf("Unknown certificate")
+            }
+            return &TestUser{cert.Subject.CommonName, ""}, nil
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig().Clone()
+    server.TLSConfig.ClientCAs = pool
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    dial := func(certs ...tls.Certificate) *textproto.Conn {
+        conn, err := net.Dial("tcp", server.Address())
+        if err != nil {
+            t.Fatalf("Should be able to dial localhost: %v", err)
+        }
+
+        c := textproto.NewConn(conn)
+        if _, _, err := c.ReadResponse(220); err != nil {
+            t.Fatalf("Expected a greeting: %v", err)
+        }
+
+        c.PrintfLine("STARTTLS")
+        if _, _, err := c.ReadResponse(220); err != nil {
+            t.Fatalf("STARTTLS failed: %v", err)
+        }
+        return textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true, Certificates: certs}))
+    }
+
+    // no certificate, nothing to authenticate with
+    c := dial()
+    c.PrintfLine("AUTH EXTERNAL =")
+    if _, _, err := c.ReadResponse(535); err != nil {
+        t.Errorf("Expected EXTERNAL without a client certificate to fail: %v", err)
+    }
+    c.Close()
+
+    c = dial(clientCert)
+    defer c.Close()
+
+    c.PrintfLine("AUTH EXTERNAL %v", base64.StdEncoding.EncodeToString([]byte("someone@example.com")))
+    if _, _, err := c.ReadResponse(535); err != nil {
+        t.Errorf("Expected EXTERNAL to refuse a different identity: %v", err)
+    }
+
+    c.PrintfLine("AUTH EXTERNAL")
+    if _, _, err := c.ReadResponse(334); err != nil {
+        t.Fatalf("Expected an empty challenge: %v", err)
+    }
+    c.PrintfLine("=")
+    if _, _, err := c.ReadResponse(235); err != nil {
+        t.Errorf("Expected EXTERNAL to succeed with a client certificate: %v", err)
+    }
+}
+
+func TestSMTPAuthExternalUnverified(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("EXTERNAL", &smtpd.AuthExternal{
+        FindUser: func(cert *x509.Certificate, identity string) (smtpd.AuthUser, error) {
+            return &TestUser{cert.Subject.CommonName, ""}, nil
+        },
+    })
+
+    // the client's certificate is requested, but nothing vouches for it
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig().Clone()
+    server.TLSConfig.ClientAuth = tls.RequestClientCert
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{
+        InsecureSkipVerify: true,
+        Certificates:       []tls.Certificate{TestingClientCert("user@example.com")},
+    }))
+    defer c.Close()
+
+    c.PrintfLine("AUTH EXTERNAL =")
+    if _, _, err := c.ReadResponse(535); err != nil {
+        t.Errorf("Expected EXTERNAL to refuse a self-signed certificate: %v", err)
+    }
+}
+
+func TestSMTPAuthImplicitTLS(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    if err := server.ListenAndServeTLS("localhost:0"); err != smtpd.ErrTLSNotConfigured {
+        t.Errorf("Expected implicit TLS without a TLSConfig to fail, got: %v", err)
+    }
+
+    server = smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, username == "user@example.com" && password == "password"
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    go server.ListenAndServeTLS("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := tls.Dial("tcp", server.Address(), &tls.Config{InsecureSkipVerify: true})
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost over TLS: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("EHLO localhost")
+    if _, msg, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    } else if strings.Contains(msg, "STARTTLS") {
+        t.Errorf("STARTTLS shouldn't be advertised on an implicit TLS connection: %v", msg)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+    if _, _, err := c.ReadResponse(235); err != nil {
+        t.Errorf("Expected PLAIN auth to succeed over implicit TLS: %v", err)
+    }
+}
+
+func TestSMTPAuthRedactsCredentials(t *testing.T) {
+    recorder := &MessageRecorder{}
+    var logged bytes.Buffer
+    server := smtpd.NewServerWithLogger(recorder.Record, log.New(&logged, "", 0))
+    server.Verbose = true
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, true
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    closed := make(chan struct{})
+    server.OnClose = func(*smtpd.Conn) {
+        close(closed)
+    }
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := net.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("STARTTLS")
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("STARTTLS failed: %v", err)
+    }
+    c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+
+    initial := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00initial-secret"))
+    c.PrintfLine("AUTH PLAIN %v", initial)
+    if _, _, err := c.ReadResponse(235); err != nil {
+        t.Fatalf("Expected PLAIN auth to succeed: %v", err)
+    }
+
+    c.PrintfLine("QUIT")
+    c.ReadResponse(221)
+    c.Close()
+
+    select {
+    case <-closed:
+    case <-time.After(time.Second):
+        t.Fatal("Expected the session to end")
+    }
+
+    if strings.Contains(logged.String(), initial) {
+        t.Errorf("Expected the credentials to be redacted from the log: %v", logged.String())
+    }
+    if !strings.Contains(logged.String(), "AUTH PLAIN [credentials redacted]") {
+        t.Errorf("Expected the AUTH command to be logged, got: %v", logged.String())
+    }
+}
+
+func TestSMTPAuthPlainWithoutTLSRequirement(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.ExtendWithOptions("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username: username}, password == "password"
+        },
+    }, smtpd.AuthOptions{RequireTLS: false})
+    serverAuth.Extend("LOGIN", &smtpd.AuthLogin{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username: username}, true
+        },
+    })
+
+    server.Auth = serverAuth
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := textproto.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer conn.Close()
+
+    if _, _, err := conn.ReadResponse(220); err != nil {
+        t.Fatalf("Expected greeting: %v", err)
+    }
+    conn.PrintfLine("EHLO localhost")
+    if _, _, err := conn.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    }
+
+    // LOGIN was registered with the defaults, so it still requires TLS
+    conn.PrintfLine("AUTH LOGIN")
+    if code, _, err := conn.ReadResponse(235); err == nil || code == 334 {
+        t.Errorf("LOGIN should not be offered over cleartext, got %v", code)
+    }
+
+    creds := base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password"))
+    conn.PrintfLine("AUTH PLAIN %v", creds)
+    if code, msg, err := conn.ReadResponse(235); err != nil {
+        t.Errorf("PLAIN should be allowed over cleartext, got %v %v", code, msg)
+    }
+}
+
+type challengeRecorder struct {
+    smtp.Auth
+    challenges []string
+}
+
+func (c *challengeRecorder) Next(fromServer []byte, more bool) ([]byte, error) {
+    if more {
+        c.challenges = append(c.challenges, string(fromServer))
+    }
+    return c.Auth.Next(fromServer, more)
+}
+
+func TestSMTPAuthPinnedClock(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    pinned := time.Date(2020, time.February, 3, 4, 5, 6, 0, time.UTC)
+    server.Now = func() time.Time { return pinned }
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("CRAM-MD5", &smtpd.AuthCramMd5{
+        FindUser: func(username string) (smtpd.AuthUser, error) {
+            return &TestUser{"user@test.com", "password"}, nil
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+
+    go server.ListenAndServe("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := textproto.Dial("tcp", server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    _, banner, err := conn.ReadResponse(220)
+    conn.Close()
+    if err != nil {
+        t.Fatalf("Expected greeting: %v", err)
+    }
+
+    if want := server.Hostname + " Mon, 03 Feb 2020 04:05:06 +0000"; banner != want {
+        t.Errorf("Wrong banner, want: %v, got: %v", want, banner)
+    }
+
+    c, err := smtp.Dial(server.Address())
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost: %v", err)
+    }
+    defer c.Close()
+
+    if err := c.StartTLS(&tls.Config{ServerName: server.Hostname, InsecureSkipVerify: true}); err != nil {
+        t.Fatalf("Should be able to negotiate some TLS? %v", err)
+    }
+
+    auth := &challengeRecorder{Auth: smtp.CRAMMD5Auth("user@test.com", "password")}
+    if err := c.Auth(auth); err != nil {
+        t.Fatalf("Auth should have succeeded: %v", err)
+    }
+
+    // the challenge is <wall time.random@hostname>, the wall time coming from the pinned clock
+    if len(auth.challenges) != 1 || !strings.HasPrefix(auth.challenges[0], "<q53y0i.") {
+        t.Errorf("Expected a challenge from the pinned clock, got: %v", auth.challenges)
+    }
+}
+
+func TestSMTPAuthMinTLSVersionImplicitTLS(t *testing.T) {
+    recorder := &MessageRecorder{}
+    server := smtpd.NewServer(recorder.Record)
+
+    serverAuth := smtpd.NewAuth()
+    serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+        Auth: func(username, password string) (smtpd.AuthUser, bool) {
+            return &TestUser{username, password}, true
+        },
+    })
+
+    server.Auth = serverAuth
+    server.TLSConfig = TestingTLSConfig()
+    server.MinAuthTLSVersion = tls.VersionTLS13
+
+    go server.ListenAndServeTLS("localhost:0")
+    defer server.Close()
+
+    WaitUntilAlive(server)
+
+    conn, err := tls.Dial("tcp", server.Address(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+    if err != nil {
+        t.Fatalf("Should be able to dial localhost over TLS: %v", err)
+    }
+    defer conn.Close()
+
+    c := textproto.NewConn(conn)
+    if _, _, err := c.ReadResponse(220); err != nil {
+        t.Fatalf("Expected a greeting: %v", err)
+    }
+
+    c.PrintfLine("EHLO localhost")
+    if _, _, err := c.ReadResponse(250); err != nil {
+        t.Fatalf("EHLO failed: %v", err)
+    }
+
+    c.PrintfLine("AUTH PLAIN %v", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+    if _, msg, err := c.ReadResponse(538); err != nil {
+        t.Errorf("Password auth should have been refused over implicit TLS 1.2: %v", err)
+    } else if msg != "Encryption too weak for requested authentication" {
+        t.Errorf("Wrong refusal, got: %v", msg)
+    }
+}
@@ -2,16 +2,24 @@ package smtpd
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// commandHistoryMax bounds the number of verbs kept by CommandHistory
+const commandHistoryMax = 100
+
 // Conn is a wrapper for net.Conn that provides
 // convenience handlers for SMTP requests
 type Conn struct {
@@ -19,66 +27,292 @@ type Conn struct {
 	net.Conn
 
 	// Track some mutable for this connection
-	IsTLS    bool
-	Errors   []error
-	User     AuthUser
-	FromAddr *mail.Address
-	ToAddr   []*mail.Address
+	IsTLS         bool
+	TLSState      *tls.ConnectionState
+	Errors        []error
+	User          AuthUser
+	AuthMechanism string
+	AuthAttempts  int
+	FromAddr      *mail.Address
+	ToAddr        []*mail.Address
+
+	// HeloHost is the domain (or address literal) the client gave with HELO/EHLO
+	HeloHost string
+
+	// BodyType is the BODY parameter given with MAIL, i.e. 7BIT or 8BITMIME, if any
+	BodyType string
+
+	// DSN holds the delivery status notification parameters given with MAIL & RCPT
+	DSN DSN
 
 	// Configuration options
 	MaxSize      int64
+	MaxDataLines int
 	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+
+	// MaxLineLength caps the lines read by ReadSMTP & ReadLine, line ending aside
+	MaxLineLength int
+	WriteTimeout  time.Duration
+	Rewriter      func(int, string) (int, string)
 
 	// internal state
 	lock        sync.Mutex
 	transaction int
+	values      map[string]interface{}
+	ehlo        bool
+	xforward    map[string]string
+	messages    int
+	lastMessage time.Time
+
+	// ESMTP extensions used in the current transaction
+	usedExtensions []string
+
+	// enhanced is set when replies carry enhanced status codes, i.e. the client
+	// used EHLO and the server has ENHANCEDSTATUSCODES enabled
+	enhanced bool
+
+	// pipelined is set once a command in the current transaction arrives
+	// before the reply to the one ahead of it has been sent
+	pipelined bool
+
+	// BDAT chunks received so far in the current transaction
+	chunks bytes.Buffer
+
+	// replies are buffered until the client is waiting on them, see Flush
+	out *bufio.Writer
+
+	// when data was last read from the client, as unix nanoseconds
+	lastActive int64
+
+	// tlsExempt is set while an AUTH mechanism registered with RequireTLS
+	// turned off is negotiating, see AuthOptions
+	tlsExempt bool
+
+	// the most recent verbs issued in this session, oldest first
+	history []string
+
+	// reverse DNS of the client, looked up on demand with lookupAddr
+	lookupAddr  func(addr string) ([]string, error)
+	reverseDNS  string
+	reverseOnce sync.Once
+
+	// the server's clock, see Server.Now
+	clock func() time.Time
 
 	asTextProto sync.Once
 	textProto   *textproto.Conn
 }
 
+// ConnInfo is a read-only snapshot of the connection a message arrived on,
+// for handlers that need more than the message itself
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	TLS        bool
+	TLSVersion uint16
+
+	// User identifies the authenticated user, if any. It's only available
+	// when the AuthUser implements fmt.Stringer
+	User string
+}
+
+// Info takes a ConnInfo snapshot of the connection
+func (c *Conn) Info() ConnInfo {
+	info := ConnInfo{
+		RemoteAddr: c.RemoteAddr(),
+		LocalAddr:  c.LocalAddr(),
+		TLS:        c.IsTLS,
+	}
+	if state, ok := c.ConnectionState(); ok {
+		info.TLSVersion = state.Version
+	}
+	if user, ok := c.User.(fmt.Stringer); ok {
+		info.User = user.String()
+	}
+	return info
+}
+
+// ConnectionState returns the negotiated TLS state of the connection, including any
+// certificates presented by the client, ok is false if the connection isn't using TLS
+func (c *Conn) ConnectionState() (state tls.ConnectionState, ok bool) {
+	if c.TLSState != nil {
+		return *c.TLSState, true
+	}
+	if tlsConn, isTLS := c.Conn.(*tls.Conn); isTLS {
+		return tlsConn.ConnectionState(), true
+	}
+	return state, false
+}
+
 // tp returns a textproto wrapper for this connection
 func (c *Conn) tp() *textproto.Conn {
 	c.asTextProto.Do(func() {
 		c.textProto = textproto.NewConn(c)
-		if c.MaxSize > 0 {
-			c.textProto.Reader = *textproto.NewReader(bufio.NewReader(io.LimitReader(c, c.MaxSize)))
-		}
 	})
 	return c.textProto
 }
 
+// Read reads from the underlying connection, keeping track of when the client was last active
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// touch marks the client as active now
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idle is how long it's been since the client was last active
+func (c *Conn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// writer returns the buffered writer replies go through
+func (c *Conn) writer() *bufio.Writer {
+	if c.out == nil {
+		c.out = bufio.NewWriter(c.Conn)
+	}
+	return c.out
+}
+
+// Flush sends any buffered replies to the client
+func (c *Conn) Flush() error {
+	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	return c.writer().Flush()
+}
+
+// flushIfIdle flushes the buffered replies before a read, unless the client has already
+// pipelined more commands, in which case those get answered in the same batch
+// see: https://tools.ietf.org/html/rfc2920#section-3.2
+func (c *Conn) flushIfIdle() error {
+	if c.tp().R.Buffered() > 0 {
+		return nil
+	}
+	return c.Flush()
+}
+
+// remoteIP returns the IP address of the client, without the port
+func (c *Conn) remoteIP() string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// ReverseDNS returns the first name the client's address resolves back to, looked up
+// the first time it's asked for and cached for the rest of the session. It's empty
+// if the address has no name, or the lookup failed
+func (c *Conn) ReverseDNS() string {
+	c.reverseOnce.Do(func() {
+		if c.lookupAddr == nil {
+			return
+		}
+		if names, err := c.lookupAddr(c.remoteIP()); err == nil && len(names) > 0 {
+			c.reverseDNS = names[0]
+		}
+	})
+	return c.reverseDNS
+}
+
+// Authenticated reports whether the client has successfully authenticated on this connection
+func (c *Conn) Authenticated() bool {
+	return c.User != nil
+}
+
+// now reads the server's clock
+func (c *Conn) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
 // StartTX starts a new MAIL transaction
 func (c *Conn) StartTX(from *mail.Address) error {
 	if c.transaction != 0 {
 		return ErrTransaction
 	}
-	c.transaction = int(time.Now().UnixNano())
+	c.transaction = int(c.now().UnixNano())
 	c.FromAddr = from
+	c.BodyType = ""
+	c.DSN = DSN{}
+	c.chunks.Reset()
+	c.usedExtensions = nil
 	return nil
 }
 
+// abortTX abandons the current MAIL transaction without a message coming of it
+func (c *Conn) abortTX() {
+	c.transaction = 0
+	c.pipelined = false
+	c.FromAddr = nil
+	c.ToAddr = make([]*mail.Address, 0)
+	c.DSN = DSN{}
+	c.chunks.Reset()
+}
+
 // EndTX closes off a MAIL transaction and returns a message object
 func (c *Conn) EndTX() error {
 	if c.transaction == 0 {
 		return ErrTransaction
 	}
 	c.transaction = 0
+	c.pipelined = false
+	c.messages++
+	c.lastMessage = c.now()
 	return nil
 }
 
 func (c *Conn) Reset() {
 	c.User = nil
+	c.AuthMechanism = ""
 	c.FromAddr = nil
 	c.ToAddr = make([]*mail.Address, 0)
 	c.transaction = 0
+	c.pipelined = false
+	c.chunks.Reset()
+	c.DSN = DSN{}
+	c.xforward = nil
+
+	c.lock.Lock()
+	c.values = nil
+	c.lock.Unlock()
+}
+
+// Set stores a per-connection value, e.g. for an extension to keep track of state
+// between commands. Values are cleared when the connection is Reset
+func (c *Conn) Set(key string, v interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = v
+}
+
+// Get retrieves a value previously stored with Set, or nil if there isn't one
+func (c *Conn) Get(key string) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
 }
 
 // ReadSMTP pulls a single SMTP command line (ending in a carriage return + newline)
 func (c *Conn) ReadSMTP() (string, string, error) {
+	if c.tp().R.Buffered() > 0 {
+		c.pipelined = true
+	}
+	if err := c.flushIfIdle(); err != nil {
+		return "", "", err
+	}
 	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
-	if line, err := c.tp().ReadLine(); err == nil {
+	if line, err := c.readLine(); err == nil {
 		var args string
 		command := strings.SplitN(line, " ", 2)
 
@@ -87,37 +321,326 @@ func (c *Conn) ReadSMTP() (string, string, error) {
 			args = command[1]
 		}
 
+		if len(c.history) >= commandHistoryMax {
+			c.history = append(c.history[:0], c.history[1:]...)
+		}
+		c.history = append(c.history, verb)
+
 		return verb, args, nil
 	} else {
 		return "", "", err
 	}
 }
 
+// CommandHistory lists the verbs the client has issued in this session, oldest first,
+// so policy hooks can spot unusual command orders. Only the most recent 100 are kept
+func (c *Conn) CommandHistory() []string {
+	return append([]string(nil), c.history...)
+}
+
 // ReadLine reads a single line from the client
 func (c *Conn) ReadLine() (string, error) {
+	if err := c.flushIfIdle(); err != nil {
+		return "", err
+	}
 	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
-	return c.tp().ReadLine()
+	return c.readLine()
+}
+
+// readLine reads a line without its line ending. A line longer than MaxLineLength
+// is read through to its end, so the session stays in sync, but ErrCommandTooLong
+// is returned in its place
+func (c *Conn) readLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := c.tp().R.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if c.MaxLineLength > 0 && len(bytes.TrimRight(line, "\r\n")) > c.MaxLineLength {
+				line, tooLong = nil, true
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", ErrCommandTooLong
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
 }
 
 // ReadData brokers the special case of SMTP data messages
 func (c *Conn) ReadData() (string, error) {
+	data, err := c.readData(0, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return data.message(), nil
+}
+
+// ReadDataWithPeek reads the data message like ReadData, but hands the first n bytes
+// of it to peek before reading the rest. An error from peek aborts the read
+func (c *Conn) ReadDataWithPeek(n int, peek func(head []byte) error) (string, error) {
+	data, err := c.readData(n, peek, nil)
+	if err != nil {
+		return "", err
+	}
+	return data.message(), nil
+}
+
+// ReadDataTo streams the data message into w as it's read, rather than holding it in
+// memory, under the same limits as ReadData. Only the message's header section, up to
+// and including the blank line that ends it, is returned
+func (c *Conn) ReadDataTo(w io.Writer) (string, error) {
+	data, err := c.readData(0, nil, w)
+	if err != nil {
+		return "", err
+	}
+	return data.buf.String(), nil
+}
+
+// readData reads the data message, handing the first n bytes of it to peek first if
+// set, and streaming it into sink if that's set
+func (c *Conn) readData(n int, peek func(head []byte) error, sink io.Writer) (*dataBuffer, error) {
+	if err := c.flushIfIdle(); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+
+	var r io.Reader = c.tp().DotReader()
+	if peek != nil {
+		br := bufio.NewReaderSize(r, n)
+
+		// a message shorter than n bytes just gets peeked in its entirety
+		head, err := br.Peek(n)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if err := peek(head); err != nil {
+			return nil, err
+		}
+		r = br
+	}
+
+	return c.readDotData(r, sink)
+}
+
+// ReadChunk reads a BDAT chunk of exactly size bytes, as is, adding it to those already
+// received in the transaction. A chunk that would take the message over MaxSize is read
+// but not kept, and ErrMessageTooBig is returned
+func (c *Conn) ReadChunk(size int64) error {
 	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
-	lines, err := c.tp().ReadDotLines()
-	return strings.Join(lines, "\n"), err
+
+	if c.MaxSize > 0 && int64(c.chunks.Len())+size > c.MaxSize {
+		if _, err := io.CopyN(ioutil.Discard, c.tp().R, size); err != nil {
+			return err
+		}
+		return ErrMessageTooBig
+	}
+
+	_, err := io.CopyN(&c.chunks, c.tp().R, size)
+	return err
+}
+
+// discardChunk reads a BDAT chunk of exactly size bytes and throws it away
+func (c *Conn) discardChunk(size int64) error {
+	c.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	_, err := io.CopyN(ioutil.Discard, c.tp().R, size)
+	return err
+}
+
+// readDotData slurps a dot-encoded message, dropping the final line ending. A message
+// over MaxSize or MaxDataLines is read through to the end, so the session stays in sync,
+// but isn't kept, and ErrMessageTooBig or ErrTooManyLines is returned instead. The limits
+// are taken afresh for every message, so they can be adjusted mid-session (e.g. after AUTH).
+// Data that ends before the terminating dot line is never returned, see ErrIncompleteData
+func (c *Conn) readDotData(r io.Reader, sink io.Writer) (*dataBuffer, error) {
+	data := &dataBuffer{sink: sink, maxBytes: c.MaxSize, maxLines: c.MaxDataLines}
+	if _, err := io.Copy(data, r); err == io.ErrUnexpectedEOF {
+		return nil, ErrIncompleteData
+	} else if err != nil {
+		return nil, err
+	}
+	if data.err != nil {
+		return nil, data.err
+	}
+	return data, nil
+}
+
+// maxStreamedHeader caps how much of a message being streamed to a sink is held on to as its header
+const maxStreamedHeader = 1 << 20
+
+// dataBuffer accumulates message data until it goes over its limits, after which
+// it discards the rest and records why. With a sink the data is passed on to it
+// instead, and only the header section is kept
+type dataBuffer struct {
+	buf      bytes.Buffer
+	maxBytes int64
+	maxLines int
+	size     int64
+	lines    int
+	err      error
+
+	sink       io.Writer
+	headerDone bool
+	eightBit   bool
+
+	// a trailing newline held back from the sink, as it may be the one before the final dot
+	held bool
+}
+
+func (b *dataBuffer) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return len(p), nil
+	}
+
+	b.size += int64(len(p))
+	b.lines += bytes.Count(p, []byte("\n"))
+	if b.maxLines > 0 && b.lines > b.maxLines {
+		b.err = ErrTooManyLines
+	} else if b.maxBytes > 0 && b.size > b.maxBytes {
+		b.err = ErrMessageTooBig
+	}
+
+	if b.err != nil {
+		b.buf.Reset()
+		return len(p), nil
+	}
+
+	if b.sink == nil {
+		return b.buf.Write(p)
+	}
+
+	b.eightBit = b.eightBit || !isASCII(string(p))
+	b.captureHeader(p)
+	if err := b.stream(p); err != nil {
+		b.err = ErrLocalProcessing
+	}
+	return len(p), nil
+}
+
+// message is the buffered message, less the line ending before the final dot
+func (b *dataBuffer) message() string {
+	return strings.TrimSuffix(b.buf.String(), "\n")
+}
+
+// captureHeader keeps the data streamed to the sink up to the end of the header section
+func (b *dataBuffer) captureHeader(p []byte) {
+	if b.headerDone {
+		return
+	}
+	// the blank line may straddle the previous write
+	from := b.buf.Len() - 1
+	if from < 0 {
+		from = 0
+	}
+	b.buf.Write(p)
+
+	data := b.buf.Bytes()
+	if bytes.HasPrefix(data, []byte("\n")) {
+		b.buf.Truncate(1)
+		b.headerDone = true
+	} else if end := bytes.Index(data[from:], []byte("\n\n")); end >= 0 {
+		b.buf.Truncate(from + end + 2)
+		b.headerDone = true
+	} else if b.buf.Len() > maxStreamedHeader {
+		b.headerDone = true
+	}
+}
+
+// stream passes p on to the sink, holding back a final newline until more data follows
+// so that, as with a buffered message, the line ending before the final dot is dropped
+func (b *dataBuffer) stream(p []byte) error {
+	if b.held {
+		if _, err := b.sink.Write([]byte("\n")); err != nil {
+			return err
+		}
+		b.held = false
+	}
+	if n := len(p); n > 0 && p[n-1] == '\n' {
+		p, b.held = p[:n-1], true
+	}
+	_, err := b.sink.Write(p)
+	return err
+}
+
+// rewrite passes a response through the configured Rewriter, if any
+func (c *Conn) rewrite(code int, message string) (int, string) {
+	if c.Rewriter != nil {
+		return c.Rewriter(code, message)
+	}
+	return code, message
+}
+
+// enhancedCodeRegex matches an RFC 3463 status code at the start of a reply
+var enhancedCodeRegex = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3} `)
+
+// withEnhancedCode gives a reply message the generic enhanced status code for its class
+// (e.g. 2.0.0) if the client gets them and it doesn't already have one. The intermediate
+// 3xx replies don't have any, see: https://tools.ietf.org/html/rfc2034#section-4
+func (c *Conn) withEnhancedCode(code int, message string) string {
+	class := code / 100
+	if !c.enhanced || (class != 2 && class != 4 && class != 5) || enhancedCodeRegex.MatchString(message) {
+		return message
+	}
+	return fmt.Sprintf("%v.0.0 %v", class, message)
+}
+
+// writeReply buffers a single reply line, sep is "-" for all but the last line of a multiline reply
+func (c *Conn) writeReply(code int, sep string, message string) error {
+	message = c.withEnhancedCode(code, message)
+	code, message = c.rewrite(code, message)
+	_, err := fmt.Fprintf(c.writer(), "%v%v%v\r\n", code, sep, message)
+	return err
 }
 
 // WriteSMTP writes a general SMTP line
 func (c *Conn) WriteSMTP(code int, message string) error {
-	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
-	_, err := c.Write([]byte(fmt.Sprintf("%v %v", code, message) + "\r\n"))
-	return err
+	return c.writeReply(code, " ", message)
+}
+
+// WriteEnhanced writes an SMTP line with a specific enhanced status code, e.g. 2.1.5,
+// which is only included if the client has negotiated ENHANCEDSTATUSCODES
+func (c *Conn) WriteEnhanced(code int, enhanced string, message string) error {
+	if c.enhanced && enhanced != "" {
+		message = fmt.Sprintf("%v %v", enhanced, message)
+	}
+	return c.WriteSMTP(code, message)
+}
+
+// WriteError writes the reply for an SMTPError, along with its enhanced status code, if any
+func (c *Conn) WriteError(err SMTPError) error {
+	return c.WriteEnhanced(err.Code, err.Enhanced, err.Error())
+}
+
+// WriteMultiline writes a multiline reply, see https://tools.ietf.org/html/rfc5321#section-4.2.1
+func (c *Conn) WriteMultiline(code int, lines ...string) error {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := c.writeReply(code, sep, line); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // WriteEHLO writes an EHLO line, see https://tools.ietf.org/html/rfc2821#section-4.1.1.1
+// Lines that would exceed the maximum reply length are refused with ErrLineTooLong
 func (c *Conn) WriteEHLO(message string) error {
-	c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
-	_, err := c.Write([]byte(fmt.Sprintf("250-%v", message) + "\r\n"))
-	return err
+	if len(message) > MaxReplyLineLength {
+		return ErrLineTooLong
+	}
+	return c.writeReply(250, "-", message)
 }
 
 // WriteOK is a convenience function for sending the default OK response
@@ -0,0 +1,103 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resolver is the part of *net.Resolver the server uses for its DNS lookups, so they
+// can be pointed at a specific recursive resolver or faked out in tests
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// resolver returns the configured Resolver, or the system's if there isn't one
+func (s *Server) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// lookupContext bounds a DNS lookup by DNSTimeout
+func (s *Server) lookupContext() (context.Context, context.CancelFunc) {
+	if s.DNSTimeout > 0 {
+		return context.WithTimeout(context.Background(), s.DNSTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// lookupAddr finds the names for an address, without their trailing dots
+func (s *Server) lookupAddr(addr string) ([]string, error) {
+	ctx, cancel := s.lookupContext()
+	defer cancel()
+
+	names, err := s.resolver().LookupAddr(ctx, addr)
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	return names, err
+}
+
+// domainResolves checks whether the domain of address has an MX record, or failing
+// that an A/AAAA record, so mail could be sent back to it. Address literals always do
+// see: https://tools.ietf.org/html/rfc5321#section-5.1
+func (s *Server) domainResolves(address string) bool {
+	domain := address[strings.LastIndex(address, "@")+1:]
+	if strings.HasPrefix(domain, "[") {
+		return true
+	}
+
+	ctx, cancel := s.lookupContext()
+	defer cancel()
+
+	if mxs, err := s.resolver().LookupMX(ctx, domain); err == nil && len(mxs) > 0 {
+		return true
+	}
+	addrs, err := s.resolver().LookupHost(ctx, domain)
+	return err == nil && len(addrs) > 0
+}
+
+// blocklisted returns the first DNSBL zone listing the client's address, if any.
+// Lookup failures are treated as not listed, so a broken list doesn't stop all mail
+// see: https://tools.ietf.org/html/rfc5782#section-2.1
+func (s *Server) blocklisted(conn *Conn) string {
+	query := reverseIP(conn.remoteIP())
+	if query == "" {
+		return ""
+	}
+
+	for _, zone := range s.DNSBL {
+		ctx, cancel := s.lookupContext()
+		addrs, err := s.resolver().LookupHost(ctx, fmt.Sprintf("%v.%v", query, strings.Trim(zone, ".")))
+		cancel()
+		if err == nil && len(addrs) > 0 {
+			return zone
+		}
+	}
+	return ""
+}
+
+// reverseIP writes an address the way DNSBLs are queried, with the octets (IPv4)
+// or nibbles (IPv6) in reverse order, empty if it isn't an IP address
+func reverseIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip[i]&0xf, ip[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
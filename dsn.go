@@ -0,0 +1,118 @@
+package smtpd
+
+import (
+	"errors"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// DSN holds the delivery status notification parameters given for a transaction,
+// for a handler that generates the notifications to honour
+// see: https://tools.ietf.org/html/rfc3461
+type DSN struct {
+	// Ret is how much of the message to return in a notification, FULL or HDRS
+	Ret string
+
+	// EnvID is the client's identifier for the transaction, returned in notifications
+	EnvID string
+
+	// Recipients holds the parameters for each of the recipients, in the order given
+	Recipients []RecipientDSN
+}
+
+// RecipientDSN holds the delivery status notification parameters for a single recipient
+type RecipientDSN struct {
+	Address *mail.Address
+
+	// Notify lists when to notify the sender: SUCCESS, FAILURE and/or DELAY, or just NEVER.
+	// It's empty when the client didn't say, leaving it up to the server
+	Notify []string
+
+	// ORcpt is the original recipient, including its address type, e.g. rfc822;user@example.com
+	ORcpt string
+}
+
+// Wants reports whether the recipient asked to be notified in the given case, e.g. FAILURE
+func (r RecipientDSN) Wants(notify string) bool {
+	for _, n := range r.Notify {
+		if n == strings.ToUpper(notify) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMailDSN pulls the RET & ENVID parameters out of those given with MAIL
+func parseMailDSN(params map[string]string) (DSN, error) {
+	var dsn DSN
+
+	if ret, ok := params["RET"]; ok {
+		dsn.Ret = strings.ToUpper(ret)
+		if dsn.Ret != "FULL" && dsn.Ret != "HDRS" {
+			return dsn, errors.New("Invalid RET parameter")
+		}
+	}
+
+	if envid, ok := params["ENVID"]; ok {
+		var err error
+		if dsn.EnvID, err = decodeXtext(envid); err != nil {
+			return dsn, errors.New("Invalid ENVID parameter")
+		}
+	}
+
+	return dsn, nil
+}
+
+// parseRcptDSN pulls the NOTIFY & ORCPT parameters out of those given with RCPT
+func parseRcptDSN(to *mail.Address, params map[string]string) (RecipientDSN, error) {
+	rcpt := RecipientDSN{Address: to}
+
+	if notify, ok := params["NOTIFY"]; ok {
+		for _, n := range strings.Split(strings.ToUpper(notify), ",") {
+			switch n {
+			case "SUCCESS", "FAILURE", "DELAY", "NEVER":
+				rcpt.Notify = append(rcpt.Notify, n)
+			default:
+				return rcpt, errors.New("Invalid NOTIFY parameter")
+			}
+		}
+
+		// NEVER can't be combined with anything else
+		if len(rcpt.Notify) > 1 && rcpt.Wants("NEVER") {
+			return rcpt, errors.New("Invalid NOTIFY parameter")
+		}
+	}
+
+	if orcpt, ok := params["ORCPT"]; ok {
+		var err error
+		if rcpt.ORcpt, err = decodeXtext(orcpt); err != nil || !strings.Contains(rcpt.ORcpt, ";") {
+			return rcpt, errors.New("Invalid ORCPT parameter")
+		}
+	}
+
+	return rcpt, nil
+}
+
+// decodeXtext decodes the +XX hex escapes of an xtext value
+// see: https://tools.ietf.org/html/rfc3461#section-4
+func decodeXtext(value string) (string, error) {
+	var decoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '+' {
+			decoded.WriteByte(value[i])
+			continue
+		}
+
+		if i+2 >= len(value) {
+			return "", errors.New("Truncated xtext escape")
+		}
+		b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", err
+		}
+		decoded.WriteByte(byte(b))
+		i += 2
+	}
+	return decoded.String(), nil
+}
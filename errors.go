@@ -1,20 +1,61 @@
 package smtpd
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // Well-defined errors
 var (
-	ErrAlreadyRunning = errors.New("This server is already listening for requests")
-	ErrAuthFailed     = SMTPError{535, errors.New("Authentication credentials invalid")}
-	ErrAuthCancelled  = SMTPError{501, errors.New("Cancelled")}
-	ErrRequiresTLS    = SMTPError{538, errors.New("Encryption required for requested authentication mechanism")}
-	ErrTransaction    = SMTPError{501, errors.New("Transaction unsuccessful")}
+	ErrAlreadyRunning    = errors.New("This server is already listening for requests")
+	ErrLineTooLong       = errors.New("Reply line exceeds the maximum line length")
+	ErrTLSNotConfigured  = errors.New("TLS is not configured on this server")
+	ErrIncompleteData    = errors.New("Message data ended without the terminating <CRLF>.<CRLF>")
+	ErrAuthFailed        = NewEnhancedError(535, "5.7.8", "Authentication credentials invalid")
+	ErrAuthCancelled     = NewEnhancedError(501, "5.7.0", "Cancelled")
+	ErrAuthRequired      = NewEnhancedError(530, "5.7.0", "Authentication required")
+	ErrRequiresTLS       = NewEnhancedError(538, "5.7.11", "Encryption required for requested authentication mechanism")
+	ErrEncryptionTooWeak = NewEnhancedError(538, "5.7.11", "Encryption too weak for requested authentication")
+	ErrTransaction       = NewEnhancedError(501, "5.5.1", "Transaction unsuccessful")
+	ErrTooManyLines      = NewEnhancedError(552, "5.3.4", "Too many lines")
+	ErrMessageTooBig     = NewEnhancedError(552, "5.3.4", "Message too big")
+	ErrNoHandler         = NewEnhancedError(554, "5.3.0", "No message handler configured")
+	ErrGreylisted        = NewEnhancedError(451, "4.7.1", "Greylisted, try again later")
+	ErrCommandTooLong    = NewEnhancedError(500, "5.5.2", "Line too long")
+	ErrLocalProcessing   = NewEnhancedError(451, "4.3.0", "Requested action aborted: local error in processing")
+
+	// ErrDropConnection can be returned by a MessageHandler to reject the message
+	// and then hang up on the client altogether
+	ErrDropConnection = NewEnhancedError(421, "4.3.0", "Closing transmission channel")
 )
 
+// RecipientErrors can be returned by a MessageHandler that delivers to each recipient
+// separately, mapping the addresses it couldn't deliver to onto why. Recipients that
+// aren't in the map (or map to nil) are taken to have succeeded
+type RecipientErrors map[string]error
+
+// Error lists the failed recipients
+func (r RecipientErrors) Error() string {
+	var failures []string
+	for address, err := range r {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", address, err))
+		}
+	}
+	sort.Strings(failures)
+	return strings.Join(failures, "; ")
+}
+
 // SMTPError is an error + SMTP response code
 type SMTPError struct {
 	Code int
 	Err  error
+
+	// Enhanced is the optional RFC 3463 status code, e.g. 5.7.8, sent to clients
+	// that have negotiated ENHANCEDSTATUSCODES
+	Enhanced string
 }
 
 // Error pulls the base error value
@@ -24,5 +65,10 @@ func (a SMTPError) Error() string {
 
 // NewError creates an SMTPError with the supplied code
 func NewError(code int, message string) SMTPError {
-	return SMTPError{code, errors.New(message)}
+	return SMTPError{Code: code, Err: errors.New(message)}
+}
+
+// NewEnhancedError creates an SMTPError with the supplied code and enhanced status code
+func NewEnhancedError(code int, enhanced string, message string) SMTPError {
+	return SMTPError{Code: code, Err: errors.New(message), Enhanced: enhanced}
 }
@@ -0,0 +1,96 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GreylistStore remembers the (IP, sender, recipient) triplets a Greylist has seen
+type GreylistStore interface {
+	Seen(key string) bool
+	Record(key string)
+}
+
+// Greylist defers the first attempt to deliver from a client IP & sender to a recipient
+// with a 451, accepting it once the client retries, as legitimate servers do but many
+// spam senders don't. Use its Handle method as the Server's RcptHandler
+// see: https://en.wikipedia.org/wiki/Greylisting_(email)
+type Greylist struct {
+	Store GreylistStore
+}
+
+// NewGreylist creates a greylist that remembers triplets in memory for ttl
+func NewGreylist(ttl time.Duration) *Greylist {
+	return &Greylist{Store: NewMemoryGreylistStore(ttl)}
+}
+
+// Handle defers recipients of triplets that haven't been seen before
+func (g *Greylist) Handle(conn *Conn, rcpt *mail.Address) error {
+	var from string
+	if conn.FromAddr != nil {
+		from = conn.FromAddr.Address
+	}
+
+	key := strings.ToLower(fmt.Sprintf("%v/%v/%v", conn.remoteIP(), from, rcpt.Address))
+	if g.Store.Seen(key) {
+		return nil
+	}
+
+	g.Store.Record(key)
+	return ErrGreylisted
+}
+
+// MemoryGreylistStore is a GreylistStore that keeps triplets in memory, forgetting
+// them once they're older than the TTL
+type MemoryGreylistStore struct {
+	TTL time.Duration
+
+	// Now is the store's clock, e.g. the Server's Now. Defaults to time.Now
+	Now func() time.Time
+
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewMemoryGreylistStore creates an empty in-memory store
+func NewMemoryGreylistStore(ttl time.Duration) *MemoryGreylistStore {
+	return &MemoryGreylistStore{TTL: ttl, seen: make(map[string]time.Time)}
+}
+
+// now reads the store's clock
+func (m *MemoryGreylistStore) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// Seen reports whether key was recorded within the TTL
+func (m *MemoryGreylistStore) Seen(key string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	recorded, ok := m.seen[key]
+	if ok && m.now().Sub(recorded) > m.TTL {
+		delete(m.seen, key)
+		return false
+	}
+	return ok
+}
+
+// Record remembers key, clearing out any expired keys along the way
+func (m *MemoryGreylistStore) Record(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	for k, recorded := range m.seen {
+		if now.Sub(recorded) > m.TTL {
+			delete(m.seen, k)
+		}
+	}
+	m.seen[key] = now
+}
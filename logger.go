@@ -0,0 +1,47 @@
+package smtpd
+
+// Logger is where the server reports what it's up to. It's satisfied by *log.Logger
+type Logger interface {
+	Print(v ...interface{})
+	Println(v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// QuietLogger is a Logger that throws everything away
+type QuietLogger struct{}
+
+// Print does nothing
+func (QuietLogger) Print(v ...interface{}) {}
+
+// Println does nothing
+func (QuietLogger) Println(v ...interface{}) {}
+
+// Printf does nothing
+func (QuietLogger) Printf(format string, v ...interface{}) {}
+
+// LogLevel sets how much the server logs, each level including those before it
+type LogLevel int
+
+// Log levels
+const (
+	// LogError only logs problems with the server itself
+	LogError LogLevel = iota
+
+	// LogInfo adds notable events in client sessions, e.g. refused connections
+	LogInfo
+
+	// LogDebug adds every command received (AUTH credentials are always redacted)
+	LogDebug
+)
+
+// SetLogLevel sets how much the server logs
+func (s *Server) SetLogLevel(level LogLevel) {
+	s.LogLevel = level
+}
+
+// logf logs the message if the server's LogLevel includes level
+func (s *Server) logf(level LogLevel, format string, v ...interface{}) {
+	if level <= s.LogLevel {
+		s.Logger.Printf(format, v...)
+	}
+}
@@ -1,16 +1,18 @@
 package smtpd
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net"
+	"net/http"
 	"net/mail"
 	"net/textproto"
 	"strings"
@@ -31,17 +33,62 @@ const (
 type Message struct {
 	To      []*mail.Address
 	From    *mail.Address
+	Sender  *mail.Address
 	Header  mail.Header
 	Subject string
 	RawBody []byte
 	Source  []byte
 
+	// TransferMethod is the SMTP command used to transfer the message content, i.e. DATA
+	TransferMethod string
+
+	// UsedExtensions lists the ESMTP extensions the client made use of for this message
+	UsedExtensions []string
+
+	// ReceivedAt is when the message finished arriving
+	ReceivedAt time.Time
+
+	// Date is parsed from the Date header, or is ReceivedAt when that's missing or malformed
+	Date time.Time
+
+	// SMTPUTF8 is set when the message arrived under SMTPUTF8 (RFC 6531), its headers
+	// may then carry raw UTF-8 and are taken as-is rather than as RFC 2047 encoded words
+	SMTPUTF8 bool
+
+	// ConnInfo describes the connection the message arrived on
+	ConnInfo ConnInfo
+
+	// RemoteAddr is the address of the client that sent the message, and HeloHost
+	// the name it gave with HELO/EHLO
+	RemoteAddr net.Addr
+	HeloHost   string
+
+	// DSN holds any delivery status notifications the client asked for
+	DSN DSN
+
+	// CharsetReader, if set, converts text parts in charsets other than UTF-8, US-ASCII
+	// and ISO-8859-1 to UTF-8, e.g. golang.org/x/net/html/charset.NewReaderLabel
+	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+	// MaxPartHeaderBytes caps the size of each MIME part's header when parsing the
+	// message's parts, zero for no cap beyond that of mime/multipart. The check is made
+	// once mime/multipart has read a header, so it refuses oversized headers rather than
+	// bounding memory, that's down to the server's MaxSize
+	MaxPartHeaderBytes int
+
 	messageID    string
 	genMessageID sync.Once
+	clock        func() time.Time
 	rcpt         []*mail.Address
 
+	warnings    []string
+	warningLock sync.Mutex
+
+	// openBody reads the body back from where it was streamed to, see Server.DataSink
+	openBody func() (io.ReadCloser, error)
+
 	// meta info
-	Logger *log.Logger
+	Logger Logger
 }
 
 // Part represents a single part of the message
@@ -50,6 +97,18 @@ type Part struct {
 	part     *multipart.Part
 	Body     []byte
 	Children []*Part
+
+	// Raw is the part exactly as it appeared in the message, headers included.
+	// Only populated where the original bytes matter, e.g. by Signed()
+	Raw []byte
+}
+
+// now reads the clock the message was created with, see MessageOptions.Now
+func (m *Message) now() time.Time {
+	if m.clock != nil {
+		return m.clock()
+	}
+	return time.Now()
 }
 
 // ID returns an identifier for this message, or generates one if none available using the masked string
@@ -59,7 +118,7 @@ func (m *Message) ID() string {
 		if m.messageID = m.Header.Get("Message-ID"); m.messageID != "" {
 			return
 		}
-		var src = rand.NewSource(time.Now().UnixNano())
+		var src = rand.NewSource(m.now().UnixNano())
 
 		b := make([]byte, idEntropy)
 		// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
@@ -98,6 +157,70 @@ func (m *Message) BCC() []*mail.Address {
 	return bcc
 }
 
+// ReturnPath returns the address from the Return-Path: header, which records the envelope
+// sender of a message that's been delivered, or nil if there isn't one. The null path <>
+// comes back as an empty address, see https://tools.ietf.org/html/rfc5321#section-4.4
+func (m *Message) ReturnPath() *mail.Address {
+	value := strings.TrimSpace(m.Header.Get("Return-Path"))
+	if value == "" {
+		return nil
+	} else if value == "<>" {
+		return &mail.Address{}
+	}
+
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// stripHeader removes every instance of the named header, folded lines included,
+// from the header section of the raw message data
+func stripHeader(data, name string) string {
+	lines := strings.SplitAfter(data, "\n")
+	kept := make([]string, 0, len(lines))
+
+	stripping := false
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r\n") == "" {
+			// the end of the headers, leave the body well alone
+			kept = append(kept, lines[i:]...)
+			break
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			field := strings.SplitN(line, ":", 2)[0]
+			stripping = strings.EqualFold(strings.TrimSpace(field), name)
+		}
+		if !stripping {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "")
+}
+
+// AutoSubmitted returns the Auto-Submitted keyword for this message (e.g. "auto-replied"),
+// defaulting to "no" when the header is absent, see https://tools.ietf.org/html/rfc3834#section-5
+func (m *Message) AutoSubmitted() string {
+	value := strings.SplitN(m.Header.Get("Auto-Submitted"), ";", 2)[0]
+	if value = strings.ToLower(strings.TrimSpace(value)); value == "" {
+		return "no"
+	}
+	return value
+}
+
+// DKIMSignatures returns the raw value of each DKIM-Signature header on the message.
+// The signatures are not verified
+func (m *Message) DKIMSignatures() []string {
+	return m.Header["Dkim-Signature"]
+}
+
+// HasDKIMSignature reports whether the message carries at least one DKIM-Signature header
+func (m *Message) HasDKIMSignature() bool {
+	return len(m.DKIMSignatures()) > 0
+}
+
 // Plain returns the text/plain content of the message, if any
 func (m *Message) Plain() ([]byte, error) {
 	return m.FindBody("text/plain")
@@ -108,51 +231,301 @@ func (m *Message) HTML() ([]byte, error) {
 	return m.FindBody("text/html")
 }
 
+// Language returns the Content-Language of this part, empty if none was given
+// see: https://tools.ietf.org/html/rfc3282
+func (p *Part) Language() string {
+	return strings.TrimSpace(p.Header.Get("Content-Language"))
+}
+
+// DetectedContentType returns the declared media type of the part, unless it's missing or
+// generic (i.e. application/octet-stream), in which case a best guess is sniffed from the
+// decoded body, see https://mimesniff.spec.whatwg.org/
+func (p *Part) DetectedContentType() string {
+	mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err == nil && mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	return http.DetectContentType(p.Body)
+}
+
+// findTypeInParts finds the first part of the given type, searching depth first so that
+// e.g. a multipart/alternative body nested within multipart/related is found
 func findTypeInParts(contentType string, parts []*Part) *Part {
 	for _, p := range parts {
 		mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
 		if err == nil && mediaType == contentType {
 			return p
 		}
+		if found := findTypeInParts(contentType, p.Children); found != nil {
+			return found
+		}
 	}
 	return nil
 }
 
-// Attachments returns the list of attachments on this message
-// XXX: this assumes that the only mimetype supporting attachments is multipart/mixed
-// need to review https://en.wikipedia.org/wiki/MIME#Multipart_messages to ensure that is the case
+// ContentType parses the message's top-level Content-Type into its media type and
+// parameters (e.g. boundary, charset). Messages without one are text/plain; charset=us-ascii
+// see: https://tools.ietf.org/html/rfc2045#section-5.2
+func (m *Message) ContentType() (mediaType string, params map[string]string, err error) {
+	contentType := m.Header.Get("Content-Type")
+	if strings.TrimSpace(contentType) == "" {
+		return "text/plain", map[string]string{"charset": "us-ascii"}, nil
+	}
+	return mime.ParseMediaType(contentType)
+}
+
+// Attachments returns the attachments on this message, wherever they sit in the MIME tree
+// (e.g. inside multipart/related): parts with an attachment disposition or a file name.
+// Inline parts referenced by Content-ID aren't attachments, see InlineParts
 func (m *Message) Attachments() ([]*Part, error) {
-	mediaType, _, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	parts, err := m.Parts()
 	if err != nil {
 		return nil, err
 	}
 
+	var attachments []*Part
+	walkParts(parts, func(part *Part) {
+		if part.isAttachment() {
+			attachments = append(attachments, part)
+		}
+	})
+	return attachments, nil
+}
+
+// InlineParts returns the parts of the message with an inline disposition, wherever they
+// sit in the MIME tree, e.g. images embedded in an HTML body
+func (m *Message) InlineParts() ([]*Part, error) {
 	parts, err := m.Parts()
 	if err != nil {
 		return nil, err
 	}
 
-	var attachments []*Part
-	if mediaType == "multipart/mixed" {
-		for _, part := range parts {
-			mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-			if err != nil {
-				return nil, err
-			}
-			if strings.HasPrefix(mediaType, "multipart/") {
-				// XXX: any cases where this would still be an attachment?
-				continue
+	var inline []*Part
+	walkParts(parts, func(part *Part) {
+		if disposition, _ := part.disposition(); disposition == "inline" {
+			inline = append(inline, part)
+		}
+	})
+	return inline, nil
+}
+
+// PartByContentID finds the part with the given Content-ID, e.g. to resolve the cid: URLs
+// in an HTML body. Angle brackets and a cid: prefix are optional
+// see: https://tools.ietf.org/html/rfc2392
+func (m *Message) PartByContentID(cid string) (*Part, error) {
+	parts, err := m.Parts()
+	if err != nil {
+		return nil, err
+	}
+
+	want := contentID(strings.TrimPrefix(cid, "cid:"))
+
+	var found *Part
+	walkParts(parts, func(part *Part) {
+		if found == nil && contentID(part.Header.Get("Content-ID")) == want {
+			found = part
+		}
+	})
+	if want == "" || found == nil {
+		return nil, fmt.Errorf("No part with Content-ID %v found", cid)
+	}
+	return found, nil
+}
+
+// contentID strips the angle brackets from a Content-ID
+func contentID(id string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+}
+
+// walkParts calls fn for each leaf part in the tree, depth first
+func walkParts(parts []*Part, fn func(*Part)) {
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+		if len(part.Children) > 0 {
+			walkParts(part.Children, fn)
+			continue
+		}
+		if mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type")); err == nil && strings.HasPrefix(mediaType, "multipart/") {
+			continue
+		}
+		fn(part)
+	}
+}
+
+// disposition parses the part's Content-Disposition, empty if it has none
+// see: https://tools.ietf.org/html/rfc2183
+func (p *Part) disposition() (string, map[string]string) {
+	disposition, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", map[string]string{}
+	}
+	return disposition, params
+}
+
+// isAttachment reports whether the part is an attachment rather than (part of) the body
+func (p *Part) isAttachment() bool {
+	disposition, params := p.disposition()
+	switch {
+	case disposition == "inline" && p.Header.Get("Content-ID") != "":
+		return false
+	case disposition == "attachment" || params["filename"] != "":
+		return true
+	}
+	_, typeParams, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	return err == nil && typeParams["name"] != ""
+}
+
+// AttachmentReader streams the decoded content of the attachment with the supplied
+// filename, without decoding (or buffering) any of the other parts of the message
+func (m *Message) AttachmentReader(name string) (io.ReadCloser, error) {
+	if name == "" {
+		return nil, fmt.Errorf("An attachment name is required")
+	}
+
+	mediaType, params, err := m.ContentType()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("No attachment named %v found", name)
+	}
+
+	body, err := m.bodyReader()
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := findAttachment(name, multipart.NewReader(newNewlineReader(body), params["boundary"]))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	var content io.Reader = part
+	if transferEncoding(part.Header) == "base64" {
+		content = base64.NewDecoder(base64.StdEncoding, part)
+	}
+
+	return &partReader{content, part, body}, nil
+}
+
+// partReader decodes the content of a multipart.Part, closing the part and the body
+// it's read from when done
+type partReader struct {
+	io.Reader
+	part *multipart.Part
+	body io.Closer
+}
+
+func (p *partReader) Close() error {
+	p.part.Close()
+	return p.body.Close()
+}
+
+// findAttachment walks the multipart tree looking for the attachment with the supplied
+// filename, descending into nested multipart sections as it goes
+func findAttachment(name string, mr *multipart.Reader) (*multipart.Part, error) {
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("No attachment named %v found", name)
+		} else if err != nil {
+			return nil, fmt.Errorf("MIME error: %v", err)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+			if found, err := findAttachment(name, multipart.NewReader(p, params["boundary"])); err == nil {
+				return found, nil
 			}
-			attachments = append(attachments, part)
+			continue
+		}
+
+		if !(&Part{Header: p.Header}).isAttachment() {
+			continue
+		}
+		if p.FileName() == name || (err == nil && params["name"] == name) {
+			return p, nil
 		}
 	}
-	return attachments, nil
+}
+
+// Signed splits a multipart/signed message (RFC 1847) into the signed content and its
+// signature, along with the micalg used. The content part's Raw bytes are preserved
+// exactly so that the signature can be verified against them
+func (m *Message) Signed() (content *Part, signature *Part, micalg string, err error) {
+	mediaType, params, err := m.ContentType()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if mediaType != "multipart/signed" {
+		return nil, nil, "", fmt.Errorf("Expected a multipart/signed message, got: %v", mediaType)
+	}
+
+	body, err := m.body()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	raw := splitRawParts(body, params["boundary"])
+	if len(raw) != 2 {
+		return nil, nil, "", fmt.Errorf("multipart/signed message should have 2 parts, found %v", len(raw))
+	}
+
+	var parts []*Part
+	for _, r := range raw {
+		tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(r)))
+		header, err := tp.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return nil, nil, "", fmt.Errorf("MIME error: %v", err)
+		}
+
+		part, err := m.readToPart(header, tp.R)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		part.Raw = r
+		parts = append(parts, part)
+	}
+
+	return parts[0], parts[1], params["micalg"], nil
+}
+
+// splitRawParts splits a multipart body on the supplied boundary without
+// decoding anything, the line ending before each delimiter belongs to the delimiter
+// see: https://tools.ietf.org/html/rfc2046#section-5.1.1
+func splitRawParts(body []byte, boundary string) [][]byte {
+	delimiter := []byte("\n--" + boundary)
+
+	// the first delimiter may be right at the start of the body
+	sections := bytes.Split(append([]byte("\n"), body...), delimiter)
+
+	var parts [][]byte
+	for _, section := range sections[1:] {
+		if bytes.HasPrefix(section, []byte("--")) {
+			// close delimiter, anything after it is epilogue
+			break
+		}
+
+		// skip the remainder of the delimiter line
+		if i := bytes.IndexByte(section, '\n'); i >= 0 {
+			section = section[i+1:]
+		} else {
+			section = nil
+		}
+		parts = append(parts, bytes.TrimSuffix(section, []byte("\r")))
+	}
+	return parts
 }
 
 // FindBody finds the first part of the message with the specified Content-Type
 func (m *Message) FindBody(contentType string) ([]byte, error) {
 
-	mediaType, _, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	mediaType, _, err := m.ContentType()
 	if err != nil {
 		return nil, err
 	}
@@ -189,8 +562,38 @@ func (m *Message) FindBody(contentType string) ([]byte, error) {
 	return part.Body, nil
 }
 
-func readToPart(header textproto.MIMEHeader, content io.Reader) (*Part, error) {
-	cte := strings.ToLower(header.Get("Content-Transfer-Encoding"))
+// transferEncoding returns the normalised Content-Transfer-Encoding of a part
+func transferEncoding(header textproto.MIMEHeader) string {
+	return strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+}
+
+// decodeBase64 decodes base64 content leniently, as it's found in the wild: whitespace
+// is skipped, padding is optional and the URL-safe alphabet is accepted as a fallback
+func decodeBase64(content []byte) ([]byte, error) {
+	stripped := bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, content)
+	stripped = bytes.TrimRight(stripped, "=")
+
+	dst := make([]byte, base64.RawStdEncoding.DecodedLen(len(stripped)))
+	n, err := base64.RawStdEncoding.Decode(dst, stripped)
+	if err != nil {
+		// some broken clients use the URL-safe alphabet
+		if n, urlErr := base64.RawURLEncoding.Decode(dst, stripped); urlErr == nil {
+			return dst[:n], nil
+		}
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// readToPart reads a part's content, undoing its transfer encoding and converting text to UTF-8
+func (m *Message) readToPart(header textproto.MIMEHeader, content io.Reader) (*Part, error) {
+	cte := transferEncoding(header)
 
 	if cte == "quoted-printable" {
 		content = quotedprintable.NewReader(content)
@@ -202,21 +605,182 @@ func readToPart(header textproto.MIMEHeader, content io.Reader) (*Part, error) {
 	}
 
 	if cte == "base64" {
-		dst := make([]byte, base64.StdEncoding.DecodedLen(len(slurp)))
-		decodedLen, err := base64.StdEncoding.Decode(dst, slurp)
-		if err != nil {
+		if slurp, err = decodeBase64(slurp); err != nil {
 			return nil, err
 		}
+	}
 
-		slurp = dst[:decodedLen]
+	if mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && strings.HasPrefix(mediaType, "text/") {
+		slurp = m.toUTF8(params["charset"], slurp)
 	}
+
 	return &Part{
 		Header: header,
 		Body:   slurp,
 	}, nil
 }
 
-func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, error) {
+// toUTF8 converts text in the given charset to UTF-8. ISO-8859-1 is handled here, other
+// charsets by the CharsetReader. Text that can't be converted is left as it is
+func (m *Message) toUTF8(charset string, text []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return text
+	case "iso-8859-1", "iso_8859-1", "latin1":
+		// each byte is the code point of the same value
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		return []byte(string(runes))
+	}
+
+	if m.CharsetReader == nil {
+		m.warn("No CharsetReader to convert text from charset %v", charset)
+		return text
+	}
+
+	r, err := m.CharsetReader(charset, bytes.NewReader(text))
+	if err != nil {
+		m.warn("Couldn't convert text from charset %v: %v", charset, err)
+		return text
+	}
+	converted, err := ioutil.ReadAll(r)
+	if err != nil {
+		m.warn("Couldn't convert text from charset %v: %v", charset, err)
+		return text
+	}
+	return converted
+}
+
+// warn records a problem with the message that was worked around while parsing it
+func (m *Message) warn(format string, v ...interface{}) {
+	warning := fmt.Sprintf(format, v...)
+
+	m.warningLock.Lock()
+	defer m.warningLock.Unlock()
+
+	// the parts are parsed afresh on each call to Parts, only keep the first of each
+	for _, w := range m.warnings {
+		if w == warning {
+			return
+		}
+	}
+	m.warnings = append(m.warnings, warning)
+}
+
+// Warnings lists the problems with the message that were tolerated while parsing it,
+// e.g. a text part in a charset that couldn't be converted. Parts are parsed on demand,
+// so their warnings show up once they've been read
+func (m *Message) Warnings() []string {
+	m.warningLock.Lock()
+	defer m.warningLock.Unlock()
+	return append([]string(nil), m.warnings...)
+}
+
+// newlineReader streams a body with its line endings made consistent, every one of them
+// ending the same way as the first, as mime/multipart expects every boundary to. It's the
+// streaming counterpart to normalizeNewlines, which can look over the whole body first
+type newlineReader struct {
+	r       *bufio.Reader
+	known   bool
+	crlf    bool
+	pending []byte
+	err     error
+}
+
+func newNewlineReader(r io.Reader) *newlineReader {
+	return &newlineReader{r: bufio.NewReader(r)}
+}
+
+func (n *newlineReader) Read(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if len(n.pending) > 0 {
+			copied := copy(p[written:], n.pending)
+			n.pending = n.pending[copied:]
+			written += copied
+			continue
+		}
+		if n.err != nil {
+			break
+		}
+
+		b, err := n.r.ReadByte()
+		if err != nil {
+			n.err = err
+			break
+		}
+
+		if b == '\r' {
+			if next, err := n.r.Peek(1); err != nil || next[0] != '\n' {
+				p[written] = b
+				written++
+				continue
+			}
+			n.r.ReadByte()
+		} else if b != '\n' {
+			p[written] = b
+			written++
+			continue
+		}
+
+		if !n.known {
+			n.known, n.crlf = true, b == '\r'
+		}
+		if n.crlf {
+			n.pending = []byte("\r\n")
+		} else {
+			n.pending = []byte("\n")
+		}
+	}
+
+	if written > 0 {
+		return written, nil
+	}
+	return 0, n.err
+}
+
+// normalizeNewlines makes a body that uses any bare LF line endings use them throughout,
+// as mime/multipart expects every boundary to end the same way as the first. Bodies that
+// are CRLF throughout are left as they are
+func normalizeNewlines(body []byte) []byte {
+	if bytes.Count(body, []byte("\n")) == bytes.Count(body, []byte("\r\n")) {
+		return body
+	}
+	return bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+}
+
+// decodeHeader decodes any RFC 2047 encoded words (e.g. =?UTF-8?B?...?=) in a header value,
+// leaving the value as it was if they can't be decoded. net/mail decodes address names
+// itself, but only in the few charsets it knows, so they're given another go here
+func decodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// partHeaderSize approximates the size of a part's header as it was sent
+func partHeaderSize(header textproto.MIMEHeader) int {
+	var size int
+	for key, values := range header {
+		for _, value := range values {
+			size += len(key) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
+
+// parseContent splits content into its parts, refusing any part whose header is over
+// MaxPartHeaderBytes, unless that's zero
+func (m *Message) parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, error) {
+	maxHeaderBytes := m.MaxPartHeaderBytes
 
 	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
 	if err != nil && err.Error() == "mime: no media type" {
@@ -238,7 +802,14 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 				return nil, fmt.Errorf("MIME error: %v", err)
 			}
 
-			part, err := readToPart(p.Header, p)
+			if size := partHeaderSize(p.Header); maxHeaderBytes > 0 && size > maxHeaderBytes {
+				return nil, fmt.Errorf("MIME error: part header of %v bytes is over the %v byte limit", size, maxHeaderBytes)
+			}
+
+			part, err := m.readToPart(p.Header, p)
+			if err != nil {
+				return nil, &ParseError{Err: fmt.Errorf("MIME error: %v", err)}
+			}
 
 			// XXX: maybe want to implement a less strict mode that gets what it can out of the message
 			// instead of erroring out on individual sections?
@@ -247,7 +818,7 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 				return nil, err
 			}
 			if strings.HasPrefix(partType, "multipart/") {
-				subParts, err := parseContent(p.Header, bytes.NewBuffer(part.Body))
+				subParts, err := m.parseContent(p.Header, bytes.NewBuffer(part.Body))
 				if err != nil {
 					return nil, err
 				}
@@ -256,7 +827,7 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 			parts = append(parts, part)
 		}
 	} else {
-		part, err := readToPart(header, content)
+		part, err := m.readToPart(header, content)
 		if err != nil {
 			return nil, err
 		}
@@ -268,7 +839,12 @@ func parseContent(header textproto.MIMEHeader, content io.Reader) ([]*Part, erro
 
 // Parts breaks a message body into its mime parts
 func (m *Message) Parts() ([]*Part, error) {
-	parts, err := parseContent(textproto.MIMEHeader(m.Header), bytes.NewBuffer(m.RawBody))
+	body, err := m.body()
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := m.parseContent(textproto.MIMEHeader(m.Header), bytes.NewBuffer(normalizeNewlines(body)))
 	if err != nil {
 		return nil, err
 	}
@@ -276,11 +852,83 @@ func (m *Message) Parts() ([]*Part, error) {
 	return parts, nil
 }
 
+// BodyReader reads the message body. That's RawBody, unless the message was streamed to
+// the server's DataSink, in which case it's read back from there instead
+func (m *Message) BodyReader() (io.ReadCloser, error) {
+	if m.openBody != nil {
+		return m.openBody()
+	}
+	return ioutil.NopCloser(bytes.NewReader(m.RawBody)), nil
+}
+
+// bodyReader opens the body, from wherever it was streamed to if it was
+func (m *Message) bodyReader() (io.ReadCloser, error) {
+	if m.openBody == nil {
+		return ioutil.NopCloser(bytes.NewReader(m.RawBody)), nil
+	}
+	return m.openBody()
+}
+
+// body is the whole message body, read back from the DataSink if need be
+func (m *Message) body() ([]byte, error) {
+	if m.openBody == nil {
+		return m.RawBody, nil
+	}
+
+	r, err := m.openBody()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// ParseError is returned when a message can't be parsed. Transient failures are
+// worth the client trying again later, anything else is a problem with the message itself
+type ParseError struct {
+	Err       error
+	Transient bool
+}
+
+// Error pulls the base error value
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Temporary reports whether the failure was transient
+func (e *ParseError) Temporary() bool {
+	return e.Transient
+}
+
+// MessageOptions carries what's known about how a message was transferred
+// into NewMessageWithOptions
+type MessageOptions struct {
+	// SMTPUTF8 is whether the client negotiated SMTPUTF8 for the transaction
+	SMTPUTF8 bool
+
+	// ReceivedAt is when the message arrived, defaulting to now
+	ReceivedAt time.Time
+
+	// Now is the clock used for the default ReceivedAt & generated IDs, defaulting
+	// to time.Now, see Server.Now
+	Now func() time.Time
+
+	// RemoteAddr & HeloHost identify the client the message came from, if known
+	RemoteAddr net.Addr
+	HeloHost   string
+}
+
 // NewMessage creates a Message from a data blob and a recipients list
-func NewMessage(data []byte, rcpt []*mail.Address, logger *log.Logger) (*Message, error) {
+func NewMessage(data []byte, rcpt []*mail.Address, logger Logger) (*Message, error) {
+	return NewMessageWithOptions(data, rcpt, logger, MessageOptions{})
+}
+
+// NewMessageWithOptions creates a Message from a data blob and a recipients list,
+// parsing it according to the transfer details in opts
+func NewMessageWithOptions(data []byte, rcpt []*mail.Address, logger Logger, opts MessageOptions) (*Message, error) {
 	m, err := mail.ReadMessage(bytes.NewBuffer(data))
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Err: err}
 	}
 
 	// this is only used to differentiate normal To: recipients from BCC:
@@ -288,12 +936,26 @@ func NewMessage(data []byte, rcpt []*mail.Address, logger *log.Logger) (*Message
 	// 3.6.
 	to, err := m.Header.AddressList("To")
 	if err != nil && err != mail.ErrHeaderNotPresent {
-		return nil, err
+		return nil, &ParseError{Err: err}
 	}
 
-	from, err := m.Header.AddressList("From")
-	if err != nil {
-		return nil, err
+	// automated senders don't always supply a usable From: address (e.g. `From: <>`),
+	// leave it nil and let the server decide whether that's acceptable
+	var warnings []string
+	var from *mail.Address
+	if fromList, err := m.Header.AddressList("From"); err == nil && len(fromList) > 0 {
+		from = fromList[0]
+	} else if err != nil && err != mail.ErrHeaderNotPresent {
+		warnings = append(warnings, fmt.Sprintf("Unparseable From header: %v", err))
+	}
+
+	// Sender is optional (RFC 5322 3.6.2), so a missing or unparseable
+	// value shouldn't cost us the whole message
+	var sender *mail.Address
+	if s := m.Header.Get("Sender"); s != "" {
+		if sender, err = mail.ParseAddress(s); err != nil {
+			warnings = append(warnings, fmt.Sprintf("Unparseable Sender header: %v", err))
+		}
 	}
 
 	header := make(map[string]string)
@@ -304,20 +966,55 @@ func NewMessage(data []byte, rcpt []*mail.Address, logger *log.Logger) (*Message
 		}
 	}
 
+	// the body has already arrived in full, so failing to read it back is on us rather than the client
 	raw, err := ioutil.ReadAll(m.Body)
 	if err != nil && err != io.EOF {
-		return nil, err
+		return nil, &ParseError{Err: err, Transient: true}
+	}
+
+	subject := m.Header.Get("subject")
+	if !opts.SMTPUTF8 {
+		subject = decodeHeader(subject)
+		for _, addr := range append(to, from, sender) {
+			if addr != nil {
+				addr.Name = decodeHeader(addr.Name)
+			}
+		}
+	}
+
+	received := opts.ReceivedAt
+	if received.IsZero() && opts.Now != nil {
+		received = opts.Now()
+	} else if received.IsZero() {
+		received = time.Now()
+	}
+	date, err := m.Header.Date()
+	if err != nil {
+		date = received
+		if err != mail.ErrHeaderNotPresent {
+			warnings = append(warnings, fmt.Sprintf("Unparseable Date header: %v", err))
+		}
 	}
 
 	return &Message{
 		rcpt:    rcpt,
 		To:      to,
-		From:    from[0],
+		From:    from,
+		Sender:  sender,
 		Header:  m.Header,
-		Subject: m.Header.Get("subject"),
+		Subject: subject,
 		RawBody: raw,
 		Source:  data,
 		Logger:  logger,
+
+		ReceivedAt: received,
+		Date:       date,
+		SMTPUTF8:   opts.SMTPUTF8,
+		RemoteAddr: opts.RemoteAddr,
+		HeloHost:   opts.HeloHost,
+
+		warnings: warnings,
+		clock:    opts.Now,
 	}, nil
 
 }
@@ -1,9 +1,15 @@
 package smtpd_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"mime"
 	"strings"
 	"testing"
+	"time"
 
 	"net/mail"
 
@@ -358,3 +364,774 @@ func TestInvalidEmailBodyStillPassesToHandler(t *testing.T) {
 		t.Error("Expected parts parsing to fail due to invalid body")
 	}
 }
+
+func TestSenderHeader(t *testing.T) {
+	withSender := `From: Author <author@example.com>
+Sender: Secretary <secretary@example.com>
+To: recipient@example.com
+Subject: On behalf of
+Content-Type: text/plain
+
+Sent by the secretary`
+
+	msg, err := smtpd.NewMessage([]byte(withSender), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if msg.From == nil || msg.From.Address != "author@example.com" {
+		t.Errorf("Wrong From address, want: author@example.com, got: %v", msg.From)
+	}
+
+	if msg.Sender == nil {
+		t.Fatal("Expected Sender to be populated")
+	} else if msg.Sender.Address != "secretary@example.com" || msg.Sender.Name != "Secretary" {
+		t.Errorf("Wrong Sender, want: Secretary <secretary@example.com>, got: %v", msg.Sender)
+	}
+
+	msg, err = smtpd.NewMessage([]byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if msg.Sender != nil {
+		t.Errorf("Expected no Sender, got: %v", msg.Sender)
+	}
+}
+
+func TestAttachmentReader(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(emailWithAttachment), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	r, err := msg.AttachmentReader("invite.ics")
+	if err != nil {
+		t.Fatal("couldn't find attachment", err)
+	}
+	defer r.Close()
+
+	streamed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("couldn't read attachment", err)
+	}
+
+	attachments, err := msg.Attachments()
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("want one attachment, got: %v (%v)", len(attachments), err)
+	}
+
+	if string(streamed) != string(attachments[0].Body) {
+		t.Errorf("Wrong attachment, wanted: %v got: %v", string(attachments[0].Body), string(streamed))
+	}
+
+	if _, err := msg.AttachmentReader("missing.ics"); err == nil {
+		t.Error("Expected an error for a missing attachment")
+	}
+
+	// the body parts have no filename, but they're not attachments either
+	if _, err := msg.AttachmentReader(""); err == nil {
+		t.Error("Expected an error for an empty name")
+	}
+}
+
+func TestAttachmentReaderOnlyAttachments(t *testing.T) {
+
+	// the line endings change part way through, and the inline image has a name too
+	msg, err := smtpd.NewMessage([]byte("From: sender@example.org\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/related; boundary=\"parts\"\r\n"+
+		"\r\n"+
+		"--parts\r\n"+
+		"Content-Type: image/gif; name=\"logo.gif\"\r\n"+
+		"Content-Disposition: inline\r\n"+
+		"Content-ID: <logo@example.org>\r\n"+
+		"\r\n"+
+		"GIF89a\n"+
+		"--parts\n"+
+		"Content-Type: text/plain; name=\"notes.txt\"\n"+
+		"Content-Disposition: attachment; filename=\"notes.txt\"\n"+
+		"\n"+
+		"first line\r\n"+
+		"second line\n"+
+		"--parts--\n"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if _, err := msg.AttachmentReader("logo.gif"); err == nil {
+		t.Error("Expected an inline part not to be read as an attachment")
+	}
+
+	r, err := msg.AttachmentReader("notes.txt")
+	if err != nil {
+		t.Fatal("couldn't find attachment", err)
+	}
+	defer r.Close()
+
+	streamed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("couldn't read attachment", err)
+	}
+	if want := "first line\r\nsecond line"; string(streamed) != want {
+		t.Errorf("Wrong attachment, want: %q, got: %q", want, streamed)
+	}
+}
+
+func TestReceivedHops(t *testing.T) {
+	withHops := `Received: from mail.example.com (mail.example.com [192.0.2.1])
+	by mx.example.net (Postfix) with ESMTPS id 4A1B2C3D
+	for <recipient@example.net>; Mon, 16 Jan 2017 16:59:33 -0500
+Received: by localhost with local id abc; garbled date
+From: Sender <sender@example.com>
+To: recipient@example.net
+Content-Type: text/plain
+
+Hello`
+
+	msg, err := smtpd.NewMessage([]byte(withHops), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	hops := msg.ReceivedHops()
+	if len(hops) != 2 {
+		t.Fatalf("want two hops, got: %v", len(hops))
+	}
+
+	if hops[0].From != "mail.example.com" || hops[0].By != "mx.example.net" || hops[0].With != "ESMTPS" || hops[0].ID != "4A1B2C3D" {
+		t.Errorf("Wrong first hop, got: %+v", hops[0])
+	}
+
+	if hops[0].Date.IsZero() || hops[0].Date.Unix() != 1484603973 {
+		t.Errorf("Wrong first hop date, got: %v", hops[0].Date)
+	}
+
+	if hops[1].From != "" || hops[1].By != "localhost" || hops[1].With != "local" || hops[1].ID != "abc" {
+		t.Errorf("Wrong second hop, got: %+v", hops[1])
+	}
+
+	if !hops[1].Date.IsZero() {
+		t.Errorf("Expected an unparseable date to be left empty, got: %v", hops[1].Date)
+	}
+}
+
+const signedEmail = `From: Sender <sender@example.com>
+To: recipient@example.com
+Subject: Signed Message
+MIME-Version: 1.0
+Content-Type: multipart/signed; micalg=pgp-sha256;
+ protocol="application/pgp-signature"; boundary="signed-boundary"
+
+This is an OpenPGP/MIME signed message (RFC 4880 and 3156)
+--signed-boundary
+Content-Type: text/plain; charset="UTF-8"
+Content-Transfer-Encoding: quoted-printable
+
+Sending bees =F0=9F=90=9D
+
+--signed-boundary
+Content-Type: application/pgp-signature; name="signature.asc"
+Content-Disposition: attachment; filename="signature.asc"
+
+-----BEGIN PGP SIGNATURE-----
+
+iQEzBAEBCAAdFiEEexampleexampleexampleexampleexampleFAlh9example
+=abcd
+-----END PGP SIGNATURE-----
+--signed-boundary--
+`
+
+func TestSignedMessage(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(signedEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	content, signature, micalg, err := msg.Signed()
+	if err != nil {
+		t.Fatal("couldn't split signed message", err)
+	}
+
+	if micalg != "pgp-sha256" {
+		t.Errorf("Wrong micalg, want: pgp-sha256, got: %v", micalg)
+	}
+
+	expectRaw := `Content-Type: text/plain; charset="UTF-8"
+Content-Transfer-Encoding: quoted-printable
+
+Sending bees =F0=9F=90=9D
+`
+	if string(content.Raw) != expectRaw {
+		t.Errorf("Signed content wasn't preserved exactly, want: %q, got: %q", expectRaw, string(content.Raw))
+	}
+
+	if strings.TrimSpace(string(content.Body)) != "Sending bees 🐝" {
+		t.Errorf("Wrong decoded content, got: %v", string(content.Body))
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(signature.Header.Get("Content-Type")); mediaType != "application/pgp-signature" {
+		t.Errorf("Wrong signature type, got: %v", mediaType)
+	}
+
+	if !strings.HasPrefix(string(signature.Body), "-----BEGIN PGP SIGNATURE-----") || !strings.HasSuffix(string(signature.Body), "-----END PGP SIGNATURE-----") {
+		t.Errorf("Wrong signature, got: %v", string(signature.Body))
+	}
+
+	msg, err = smtpd.NewMessage([]byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if _, _, _, err := msg.Signed(); err == nil {
+		t.Error("Expected an error splitting an unsigned message")
+	}
+}
+
+func TestAutoSubmitted(t *testing.T) {
+	autoReply := `From: Sender <sender@example.com>
+To: recipient@example.com
+Subject: Out of office
+Auto-Submitted: auto-replied; owner-email="sender@example.com"
+Content-Type: text/plain
+
+I'm away`
+
+	msg, err := smtpd.NewMessage([]byte(autoReply), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if v := msg.AutoSubmitted(); v != "auto-replied" {
+		t.Errorf("Wrong Auto-Submitted, want: auto-replied, got: %v", v)
+	}
+
+	msg, err = smtpd.NewMessage([]byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if v := msg.AutoSubmitted(); v != "no" {
+		t.Errorf("Expected Auto-Submitted to default to no, got: %v", v)
+	}
+}
+
+func TestDKIMSignatures(t *testing.T) {
+	signed := `DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=selector;
+ c=relaxed/relaxed; h=from:to:subject; bh=abc=; b=def=
+From: Sender <sender@example.com>
+To: recipient@example.com
+Subject: Signed
+Content-Type: text/plain
+
+Hello`
+
+	msg, err := smtpd.NewMessage([]byte(signed), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if !msg.HasDKIMSignature() {
+		t.Error("Expected a DKIM signature to be found")
+	}
+
+	if sigs := msg.DKIMSignatures(); len(sigs) != 1 || !strings.Contains(sigs[0], "d=example.com") {
+		t.Errorf("Wrong DKIM signatures, got: %v", sigs)
+	}
+
+	msg, err = smtpd.NewMessage([]byte(plainHTMLEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if msg.HasDKIMSignature() || len(msg.DKIMSignatures()) != 0 {
+		t.Errorf("Expected no DKIM signatures, got: %v", msg.DKIMSignatures())
+	}
+}
+
+func TestBase64Leniency(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="parts"
+
+--parts
+Content-Type: text/plain
+Content-Transfer-Encoding: base64
+
+aGVsbG8gd29ybGQhIQ==
+--parts
+Content-Type: text/plain
+Content-Transfer-Encoding: BASE64 
+
+aGVsbG8gd29y
+bGQhIQ
+--parts
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+
+-__-
+--parts--
+`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	parts, err := msg.Parts()
+	if err != nil {
+		t.Fatalf("Expected the parts to decode: %v", err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got: %v", len(parts))
+	}
+
+	for i, want := range []string{"hello world!!", "hello world!!", "\xfb\xff\xfe"} {
+		if got := string(parts[i].Body); got != want {
+			t.Errorf("Part %v decoded wrong, want: %q, got: %q", i, want, got)
+		}
+	}
+}
+
+func TestPartLanguage(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="langs"
+
+--langs
+Content-Type: text/plain
+Content-Language: en
+
+Hello
+--langs
+Content-Type: text/plain
+Content-Language: fr-CA
+
+Bonjour
+--langs
+Content-Type: text/plain
+
+?
+--langs--
+`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	parts, err := msg.Parts()
+	if err != nil {
+		t.Fatalf("Expected the parts to parse: %v", err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got: %v", len(parts))
+	}
+
+	for i, want := range []string{"en", "fr-CA", ""} {
+		if got := parts[i].Language(); got != want {
+			t.Errorf("Part %v has the wrong language, want: %q, got: %q", i, want, got)
+		}
+	}
+}
+
+func TestMessageContentType(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="frontier"
+
+--frontier
+Content-Type: text/plain
+
+hello
+--frontier--
+`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	mediaType, params, err := msg.ContentType()
+	if err != nil {
+		t.Fatalf("Expected the Content-Type to parse: %v", err)
+	} else if mediaType != "multipart/mixed" || params["boundary"] != "frontier" {
+		t.Errorf("Wrong Content-Type, got: %v %v", mediaType, params)
+	}
+
+	msg, err = smtpd.NewMessage([]byte("From: sender@example.org\nTo: recipient@example.net\n\nhello"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	mediaType, params, err = msg.ContentType()
+	if err != nil {
+		t.Fatalf("Expected a missing Content-Type to default: %v", err)
+	} else if mediaType != "text/plain" || params["charset"] != "us-ascii" {
+		t.Errorf("Wrong default Content-Type, got: %v %v", mediaType, params)
+	}
+}
+
+func TestDetectedContentType(t *testing.T) {
+
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	msg, err := smtpd.NewMessage([]byte(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="parts"
+
+--parts
+Content-Type: text/html
+
+<p>hello</p>
+--parts
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename="image"
+Content-Transfer-Encoding: base64
+
+`+png+`
+--parts--
+`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	parts, err := msg.Parts()
+	if err != nil {
+		t.Fatalf("Expected the parts to parse: %v", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts, got: %v", len(parts))
+	}
+
+	if got := parts[0].DetectedContentType(); got != "text/html" {
+		t.Errorf("Expected the declared type to be kept, got: %v", got)
+	}
+	if got := parts[1].DetectedContentType(); got != "image/png" {
+		t.Errorf("Expected the octet-stream to be sniffed as image/png, got: %v", got)
+	}
+}
+
+func TestMaxPartHeaderBytes(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="parts"
+
+--parts
+Content-Type: text/plain
+X-Padding: `+strings.Repeat("x", 4096)+`
+
+hello
+--parts--
+`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if _, err := msg.Parts(); err != nil {
+		t.Errorf("Expected the parts to parse without a limit: %v", err)
+	}
+
+	msg.MaxPartHeaderBytes = 1024
+	if parts, err := msg.Parts(); err == nil {
+		t.Errorf("Expected the oversized part header to be refused, got: %v parts", len(parts))
+	} else if !strings.Contains(err.Error(), "over the 1024 byte limit") {
+		t.Errorf("Wrong error, got: %v", err)
+	}
+}
+
+func TestMixedLineEndings(t *testing.T) {
+
+	headers := strings.Join([]string{
+		"From: sender@example.org",
+		"To: recipient@example.net",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="mixed"`,
+		"", "",
+	}, "\r\n")
+	// the body's line endings are a mixture of bare LF and CRLF
+	body := "--mixed\nContent-Type: text/plain\r\n\nplain text\n--mixed\r\n" +
+		"Content-Type: text/html\n\r\n<p>html</p>\r\n--mixed--\n"
+
+	msg, err := smtpd.NewMessage([]byte(headers+body), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	parts, err := msg.Parts()
+	if err != nil {
+		t.Fatalf("Expected the parts to parse: %v", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("Expected 2 parts, got: %v", len(parts))
+	}
+
+	for i, want := range []string{"plain text", "<p>html</p>"} {
+		if got := string(parts[i].Body); got != want {
+			t.Errorf("Part %v has the wrong body, want: %q, got: %q", i, want, got)
+		}
+	}
+
+	if plain, err := msg.Plain(); err != nil || string(plain) != "plain text" {
+		t.Errorf("Wrong plain text, got: %q (%v)", plain, err)
+	}
+}
+
+func TestEncodedWords(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(`From: =?ISO-8859-1?Q?Andr=E9_Pirard?= <andre@example.org>
+To: =?UTF-8?Q?J=C3=BCrgen?= <jurgen@example.net>, plain@example.net
+Subject: =?UTF-8?B?5pel5pys6Kqe44Gu?= =?UTF-8?B?5Lu25ZCN?=
+
+hello`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if msg.Subject != "日本語の件名" {
+		t.Errorf("Wrong subject, got: %v", msg.Subject)
+	}
+	if msg.From.Name != "André Pirard" {
+		t.Errorf("Wrong From name, got: %v", msg.From.Name)
+	}
+	if len(msg.To) != 2 || msg.To[0].Name != "Jürgen" || msg.To[1].Name != "" {
+		t.Errorf("Wrong To names, got: %v", msg.To)
+	}
+
+	msg, err = smtpd.NewMessage([]byte("Subject: =?bogus?Q?nope?=\n\nhello"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+	if msg.Subject != "=?bogus?Q?nope?=" {
+		t.Errorf("Expected an undecodable subject to be left alone, got: %v", msg.Subject)
+	}
+}
+
+func TestPartCharsets(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte("From: sender@example.org\n"+
+		"To: recipient@example.net\n"+
+		"MIME-Version: 1.0\n"+
+		"Content-Type: multipart/mixed; boundary=\"parts\"\n\n"+
+		"--parts\n"+
+		"Content-Type: text/plain; charset=ISO-8859-1\n"+
+		"Content-Transfer-Encoding: quoted-printable\n\n"+
+		"Caf=E9 cr=E8me br=FBl=E9e\n"+
+		"--parts\n"+
+		"Content-Type: text/plain; charset=\"iso-8859-1\"\n\n"+
+		"na\xefve\n"+
+		"--parts\n"+
+		"Content-Type: text/plain; charset=x-rot13\n\n"+
+		"uryyb\n"+
+		"--parts\n"+
+		"Content-Type: application/octet-stream\n\n"+
+		"\xe9\n"+
+		"--parts--\n"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	msg.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if charset != "x-rot13" {
+			return nil, fmt.Errorf("Unknown charset %v", charset)
+		}
+		text, err := ioutil.ReadAll(input)
+		for i, b := range text {
+			if b >= 'a' && b <= 'z' {
+				text[i] = 'a' + (b-'a'+13)%26
+			}
+		}
+		return bytes.NewReader(text), err
+	}
+
+	parts, err := msg.Parts()
+	if err != nil {
+		t.Fatalf("Expected the parts to parse: %v", err)
+	}
+	if len(parts) != 4 {
+		t.Fatalf("Expected 4 parts, got: %v", len(parts))
+	}
+
+	for i, want := range []string{"Café crème brûlée", "naïve", "hello", "\xe9"} {
+		if got := string(parts[i].Body); got != want {
+			t.Errorf("Part %v decoded wrong, want: %q, got: %q", i, want, got)
+		}
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte("From: sender@example.org\n"+
+		"To: recipient@example.net\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 -0700\n\n"+
+		"hello\n"), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if want := time.Date(2006, time.January, 2, 22, 4, 5, 0, time.UTC); !msg.Date.Equal(want) {
+		t.Errorf("Wrong date, expected %v got %v", want, msg.Date)
+	}
+
+	msg, err = smtpd.NewMessage([]byte("From: sender@example.org\n"+
+		"To: recipient@example.net\n"+
+		"Date: sometime last tuesday\n\n"+
+		"hello\n"), nil, nil)
+	if err != nil {
+		t.Fatal("A malformed date shouldn't fail the message", err)
+	}
+
+	if !msg.Date.Equal(msg.ReceivedAt) {
+		t.Errorf("Expected a malformed date to fall back to %v, got %v", msg.ReceivedAt, msg.Date)
+	}
+}
+
+const relatedEmail = `From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/related; boundary="related"
+
+--related
+Content-Type: multipart/alternative; boundary="alt"
+
+--alt
+Content-Type: text/plain
+
+See the logo
+--alt
+Content-Type: text/html
+
+<p>See the logo <img src="cid:logo@example.org"></p>
+--alt--
+--related
+Content-Type: image/gif; name="logo.gif"
+Content-Disposition: inline; filename="logo.gif"
+Content-ID: <logo@example.org>
+Content-Transfer-Encoding: base64
+
+R0lGODlhAQABAAAAACw=
+--related
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="report.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQ=
+--related--
+--outer--
+`
+
+func TestRelatedAttachments(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(relatedEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	attachments, err := msg.Attachments()
+	if err != nil {
+		t.Fatal("couldn't load attachments", err)
+	}
+
+	if len(attachments) != 1 {
+		t.Fatalf("want one attachment, got: %v", len(attachments))
+	}
+
+	if string(attachments[0].Body) != "%PDF-1.4" {
+		t.Errorf("Wrong attachment, got: %q", attachments[0].Body)
+	}
+
+	inline, err := msg.InlineParts()
+	if err != nil {
+		t.Fatal("couldn't load inline parts", err)
+	}
+
+	if len(inline) != 1 || inline[0].Header.Get("Content-ID") != "<logo@example.org>" {
+		t.Fatalf("want the inline logo, got: %v", inline)
+	}
+}
+
+func TestPartByContentID(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(relatedEmail), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	html, err := msg.HTML()
+	if err != nil {
+		t.Fatal("couldn't find the HTML body", err)
+	}
+
+	start := bytes.Index(html, []byte(`src="cid:`))
+	if start < 0 {
+		t.Fatalf("Expected a cid: reference in the HTML, got: %s", html)
+	}
+	ref := html[start+len(`src="`):]
+	ref = ref[:bytes.IndexByte(ref, '"')]
+
+	part, err := msg.PartByContentID(string(ref))
+	if err != nil {
+		t.Fatalf("Should be able to resolve %s: %v", ref, err)
+	}
+
+	if part.DetectedContentType() != "image/gif" || !bytes.HasPrefix(part.Body, []byte("GIF89a")) {
+		t.Errorf("Resolved the wrong part for %s: %v", ref, part.Header)
+	}
+
+	if _, err := msg.PartByContentID("missing@example.org"); err == nil {
+		t.Error("Expected an error for a missing Content-ID")
+	}
+}
+
+func TestBase64MisplacedPadding(t *testing.T) {
+
+	msg, err := smtpd.NewMessage([]byte(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="parts"
+
+--parts
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+
+QU=JD
+--parts--
+`), nil, nil)
+	if err != nil {
+		t.Fatal("error creating message", err)
+	}
+
+	if parts, err := msg.Parts(); err == nil {
+		t.Errorf("Expected padding mid-content to be refused, got: %q", parts[0].Body)
+	}
+}
+
+func TestMessageIDPinnedClock(t *testing.T) {
+
+	pinned := time.Date(2020, time.February, 3, 4, 5, 6, 0, time.UTC)
+	opts := smtpd.MessageOptions{Now: func() time.Time { return pinned }}
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		msg, err := smtpd.NewMessageWithOptions([]byte("From: sender@example.org\nSubject: hi\n\nhello"), nil, nil, opts)
+		if err != nil {
+			t.Fatal("error creating message", err)
+		}
+		if !msg.ReceivedAt.Equal(pinned) {
+			t.Errorf("Expected ReceivedAt from the pinned clock, got: %v", msg.ReceivedAt)
+		}
+		ids = append(ids, msg.ID())
+	}
+
+	// the generated ID is seeded from the clock, so a pinned clock makes it repeatable
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Expected the same ID from the same clock, got: %v", ids)
+	}
+}
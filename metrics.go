@@ -0,0 +1,31 @@
+package smtpd
+
+import "time"
+
+// Metrics receives measurements of the server at work, e.g. to export to a monitoring system
+type Metrics interface {
+	// CommandSeen is called once the server has replied to a command, with how long
+	// it took from the command being read to the reply being written. Replies batched
+	// up for a pipelining client are counted as written once they're queued
+	CommandSeen(verb string, dur time.Duration)
+}
+
+// commandTimer times the command currently being handled in a session
+type commandTimer struct {
+	verb    string
+	started time.Time
+}
+
+// finishCommand reports how long the command being timed took, if there is one
+func (s *Server) finishCommand(timer *commandTimer) {
+	if timer.verb == "" {
+		return
+	}
+
+	dur := time.Since(timer.started)
+	if s.Metrics != nil {
+		s.Metrics.CommandSeen(timer.verb, dur)
+	}
+	s.logf(LogDebug, "%v took %v", timer.verb, dur)
+	timer.verb = ""
+}
@@ -0,0 +1,132 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// ReceivedHop is a best-effort breakdown of a single Received: header,
+// fields are left empty when they couldn't be found
+// see: https://tools.ietf.org/html/rfc5321#section-4.4
+type ReceivedHop struct {
+	From string
+	By   string
+	With string
+	ID   string
+	Date time.Time
+
+	// Raw is the unparsed header value
+	Raw string
+}
+
+// ReceivedHops parses each of the message's Received: headers, most recent hop first
+func (m *Message) ReceivedHops() []ReceivedHop {
+	var hops []ReceivedHop
+	for _, received := range m.Header["Received"] {
+		hops = append(hops, parseReceived(received))
+	}
+	return hops
+}
+
+// parseReceived pulls what it can out of a Received: header. They're notoriously
+// irregular in the wild, so anything unexpected is skipped rather than treated as an error
+func parseReceived(value string) ReceivedHop {
+	hop := ReceivedHop{Raw: value}
+
+	clauses := value
+	if i := strings.LastIndex(value, ";"); i >= 0 {
+		clauses = value[:i]
+		if date, err := mail.ParseDate(strings.TrimSpace(value[i+1:])); err == nil {
+			hop.Date = date
+		}
+	}
+
+	tokens := strings.Fields(stripComments(clauses))
+	for i := 0; i < len(tokens)-1; i++ {
+		var field *string
+		switch strings.ToLower(tokens[i]) {
+		case "from":
+			field = &hop.From
+		case "by":
+			field = &hop.By
+		case "with":
+			field = &hop.With
+		case "id":
+			field = &hop.ID
+		default:
+			continue
+		}
+
+		if *field == "" {
+			*field = tokens[i+1]
+		}
+		i++
+	}
+
+	return hop
+}
+
+// stripComments removes (possibly nested) parenthesized comments from a header value
+func stripComments(value string) string {
+	var depth int
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '(':
+			depth++
+			return ' '
+		case r == ')' && depth > 0:
+			depth--
+			return ' '
+		case depth > 0:
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// receivedHeader builds the Received: trace header for a message arriving over conn, see
+// https://tools.ietf.org/html/rfc5321#section-4.4. Attributes supplied by a trusted
+// relay via XFORWARD take precedence over what we can see of the connection
+func (s *Server) receivedHeader(conn *Conn) string {
+	helo := conn.HeloHost
+	addr := conn.remoteIP()
+	var name string
+
+	// https://tools.ietf.org/html/rfc3848
+	proto := "SMTP"
+	if conn.ehlo {
+		proto = "ESMTP"
+		if conn.IsTLS {
+			proto += "S"
+		}
+		if conn.User != nil {
+			proto += "A"
+		}
+	}
+
+	if v := conn.xforward["HELO"]; v != "" {
+		helo = v
+	}
+	if v := conn.xforward["NAME"]; v != "" {
+		name = v
+	}
+	if v := conn.xforward["ADDR"]; v != "" {
+		addr = v
+	}
+	if v := conn.xforward["PROTO"]; v != "" {
+		proto = v
+	}
+
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	from := fmt.Sprintf("%v ([%v])", helo, addr)
+	if name != "" {
+		from = fmt.Sprintf("%v (%v [%v])", helo, name, addr)
+	}
+
+	return fmt.Sprintf("Received: from %v\n\tby %v with %v;\n\t%v\n", from, s.hostname(), proto, s.now().Format(time.RFC1123Z))
+}
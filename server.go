@@ -1,8 +1,10 @@
 package smtpd
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,73 +12,321 @@ import (
 	"net/mail"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // MessageHandler functions handle application of business logic to the inbound message
 type MessageHandler func(m *Message) error
 
+// HandlerResult can be returned by a MessageHandler to accept the message with a reply of
+// its own, e.g. "Accepted, flagged for review". It only satisfies error so that it can be
+// returned by a handler, it doesn't count as a failure. Code defaults to 250
+type HandlerResult struct {
+	Code    int
+	Message string
+}
+
+func (r HandlerResult) Error() string {
+	return r.Message
+}
+
+// code is the reply code to use, which has to be a positive completion
+func (r HandlerResult) code() int {
+	if r.Code < 200 || r.Code > 299 {
+		return 250
+	}
+	return r.Code
+}
+
 // Default values
 const (
 	DefaultReadTimeout        = time.Second * 10
 	DefaultWriteTimeout       = time.Second * 10
 	DefaultMessageSizeMax     = 131072
 	DefaultSessionCommandsMax = 100
+	DefaultHeloLengthMax      = 255
+	DefaultLineLengthMax      = 12288
+	DefaultOverloadMessage    = "Too many connections, try again later"
+	DefaultMessageBuffer      = 16
+	DefaultMessageTimeout     = time.Second * 5
+	DefaultDNSTimeout         = time.Second * 5
+	DefaultTarpitDelay        = time.Second
+	DefaultTarpitMax          = time.Second * 30
+
+	// MaxReplyLineLength is the longest text that fits in a single reply line, once the
+	// code, separator and CRLF are accounted for, see https://tools.ietf.org/html/rfc5321#section-4.5.3.1.5
+	MaxReplyLineLength = 512 - 6
 )
 
+// minReapInterval is the shortest period between idle connection sweeps
+const minReapInterval = 10 * time.Millisecond
+
 // Server is an RFC2821/5321 compatible SMTP server
 type Server struct {
+	// Hostname is the name the server gives in its banner, in reply to EHLO and in
+	// TLS, e.g. the public MX name. Defaults to the OS hostname
+	Hostname string
+
+	// Deprecated: Name is an alias for Hostname, used if it's changed from the default
 	Name string
 
-	TLSConfig  *tls.Config
+	TLSConfig *tls.Config
+
+	// Deprecated: ServerName is an alias for Hostname, used if it's changed from the default
 	ServerName string
 
+	// defaultHostname is what NewServer set all of the names to
+	defaultHostname string
+
+	// RequireTLS refuses mail transactions until the client has issued STARTTLS, so
+	// it needs a TLSConfig, without one ListenAndServe returns ErrTLSNotConfigured
+	RequireTLS bool
+
 	// MaxSize of incoming message objects, zero for no cap otherwise
-	// larger messages are thrown away
+	// larger messages are thrown away and refused with a 552
 	MaxSize int64
 
-	// MaxConn limits the number of concurrent connections being handled
-	MaxConn int
+	// SMTPUTF8 advertises support for internationalized addresses & headers (RFC 6531).
+	// Without it, or the SMTPUTF8 parameter on MAIL, addresses must be ASCII
+	SMTPUTF8 bool
+
+	// StripReturnPath removes any Return-Path: header supplied by the client, as it's
+	// for the delivering server to add, see https://tools.ietf.org/html/rfc5321#section-4.4
+	StripReturnPath bool
+
+	// Reject8BitWithout8BITMIME refuses message data containing 8-bit bytes from clients
+	// that didn't declare BODY=8BITMIME (or SMTPUTF8), rather than accepting it as is
+	Reject8BitWithout8BITMIME bool
+
+	// MaxDataLines caps the number of lines in a message, zero for no cap
+	MaxDataLines int
+
+	// MaxAttachmentBytes caps the combined decoded size of a message's attachments, zero for no cap
+	MaxAttachmentBytes int64
+
+	// MaxConn limits the number of concurrent connections being handled, connections
+	// over the limit are turned away with a 554 and the OverloadMessage. Zero for no limit
+	MaxConn         int
+	OverloadMessage string
+
+	// EchoClient includes the client's HELO/EHLO name and IP address in the greeting,
+	// e.g. 250 mx.example.com Hello client.example.net [192.0.2.1]
+	EchoClient bool
+
+	// MaxHeloLength caps the length of the HELO/EHLO domain argument, zero for no cap
+	MaxHeloLength int
+
+	// MaxLineLength caps each command line, or AUTH response, read from the client, zero
+	// for no cap. The default allows for AUTH, see https://tools.ietf.org/html/rfc4954#section-4
+	MaxLineLength int
+
+	// ValidateHelo rejects a HELO/EHLO argument that isn't a plausible domain name
+	// or address literal, e.g. example.com or [192.0.2.1]
+	ValidateHelo bool
+
+	// AllowNullSender accepts MAIL FROM:<>, as used for bounces. NewServer enables it
+	AllowNullSender bool
+
+	// RequireResolvableSender temporarily rejects MAIL FROM addresses whose domain has
+	// neither an MX nor an A/AAAA record, using the Resolver. The null sender is exempt
+	RequireResolvableSender bool
+
+	// RequireValidFrom rejects messages without a parseable From: address
+	RequireValidFrom bool
+
+	// StrictCommands closes the session with a 554 when the client sends something that
+	// looks like message content (e.g. a header or MIME boundary) in place of a command
+	StrictCommands bool
 
 	// MaxCommands is the maximum number of commands a server will accept
 	// from a single client before terminating the session
 	MaxCommands int
 
-	// RateLimiter gets called before proceeding through to message handling
-	// TODO: Implement
+	// BadCommandTarpit keeps clients that have sent too many unrecognized commands
+	// talking rather than disconnecting them, but delays each further reply by TarpitDelay,
+	// doubling with every bad command up to TarpitMax, to waste a spammer's time
+	BadCommandTarpit bool
+	TarpitDelay      time.Duration
+	TarpitMax        time.Duration
+
+	// MaxMessagesPerConn caps the number of messages a single connection may send, and
+	// MessageInterval is the minimum time allowed between them. Zero for no limit
+	MaxMessagesPerConn int
+	MessageInterval    time.Duration
+
+	// ConnectionHandler gets called for each new connection before it's greeted, returning
+	// an error turns the client away, e.g. with NewEnhancedError(554, "5.7.1", "Access denied")
+	ConnectionHandler func(conn *Conn) error
+
+	// RateLimiter gets called once a client has been greeted, returning false turns it
+	// away with a 421 before it can issue any commands
 	RateLimiter func(*Conn) bool
 
-	// Handler is the handoff function for messages
-	Handler MessageHandler
+	// Handler is the handoff function for messages, further handlers can be added with AddHandler
+	Handler      MessageHandler
+	handlers     []MessageHandler
+	handlersLock sync.RWMutex
+
+	// MessageBuffer is the capacity of the channel returned by Messages, and MessageTimeout
+	// how long to wait for room in it before turning the message away with a 451
+	MessageBuffer  int
+	MessageTimeout time.Duration
+	messages       chan *Message
+	messagesOnce   sync.Once
+	messagesLock   sync.RWMutex
+	messagesClosed bool
+
+	// RcptHandler, if set, decides whether to accept each RCPT TO, an SMTPError is sent
+	// as the reply to a rejected recipient. The rest of the transaction carries on regardless
+	RcptHandler func(conn *Conn, rcpt *mail.Address) error
+
+	// Verifier, if set, answers VRFY for the given address instead of the default non-committal
+	// 252. A nil error means the mailbox exists, an SMTPError is sent as the reply
+	Verifier func(conn *Conn, address string) error
+
+	// PeekHandler, if set, is handed the first PeekBytes of the DATA stream before the
+	// rest is read. Returning an error rejects the message and closes the connection
+	PeekBytes   int
+	PeekHandler func(conn *Conn, head []byte) error
+
+	// DataSink, if set, has each DATA message streamed into the writer it returns (e.g. a
+	// temp file) as it's read, rather than held in memory. Only the header is kept, the
+	// Message's body is read back from the sink as needed, see Message.BodyReader, so the
+	// writer must be an *os.File or implement DataSource. It's closed once the DATA is in,
+	// and removed again unless the message is accepted
+	DataSink func(conn *Conn) (io.WriteCloser, error)
+
+	// MaxConcurrentParse limits how many messages may be parsed & screened (i.e. attachment
+	// limits and ScoreFunc) at once across all connections, zero for no limit
+	MaxConcurrentParse int
+	parseSlots         chan struct{}
+	parseSlotsOnce     sync.Once
+
+	// ScoreFunc, if set, scores each message (e.g. with SpamAssassin) before it is
+	// handled, messages scoring RejectScore or higher are rejected as spam
+	ScoreFunc   func(*Message) (float64, error)
+	RejectScore float64
+
+	// OnClose gets called once a client session has ended and its connection is closed
+	OnClose func(*Conn)
 
 	// Auth is an authentication-handling extension
 	Auth Extension
 
-	// Extensions is a map of server-specific extensions & overrides, by verb
+	// AuthRequiredResponse replaces the default ErrAuthRequired reply sent when an
+	// unauthenticated client issues a command that requires authentication
+	AuthRequiredResponse SMTPError
+
+	// EnhancedStatusCodes advertises ENHANCEDSTATUSCODES (RFC 2034) and adds the
+	// x.y.z status codes (RFC 3463) to replies for clients that EHLO
+	EnhancedStatusCodes bool
+
+	// MinAuthTLSVersion refuses password based AUTH mechanisms over TLS connections
+	// that negotiated an older version, e.g. tls.VersionTLS12. Zero for no minimum
+	MinAuthTLSVersion uint16
+
+	// MaxAuthAttempts is the number of failed AUTH attempts a client gets, across
+	// all mechanisms, before being disconnected. Zero for no limit
+	MaxAuthAttempts int
+
+	// OnAuthSuccess gets called after a client successfully authenticates and before
+	// the reply is sent, e.g. to adjust connection settings for the user
+	OnAuthSuccess func(conn *Conn, user AuthUser)
+
+	// Resolver is used for all DNS lookups, defaulting to the system resolver, and
+	// DNSTimeout bounds each of them
+	Resolver   Resolver
+	DNSTimeout time.Duration
+
+	// DNSBL is a list of DNS blocklist zones, e.g. zen.spamhaus.org, clients listed
+	// in any of them are turned away with a 554 before being greeted
+	DNSBL []string
+
+	// TrustXForward decides whether a client is a relay trusted to pass along
+	// the original client's details with XFORWARD. Nil trusts no one
+	TrustXForward func(*Conn) bool
+
+	// Extensions is a map of server-specific extensions & overrides, by verb. An override
+	// of BDAT has to read the chunk that follows the command itself
 	Extensions map[string]Extension
 
 	// Disabled features
 	Disabled map[string]bool
 
-	// Server meta
-	listener *net.Listener
+	// ListenConfig, if set, is used to create the listener, e.g. with a Control
+	// function setting SO_REUSEADDR/SO_REUSEPORT for zero-downtime restarts
+	ListenConfig *net.ListenConfig
+
+	// Server meta, the listener is guarded by listenerLock as it's swapped by ReplaceListener
+	listener     *net.Listener
+	listenerLock sync.Mutex
+
+	// replaced tells the accept loop that ReplaceListener has swapped the listener
+	replaced chan struct{}
 
 	// help message to display in response to a HELP request
 	Help string
 
-	// Logger to print out status info
-	// TODO: implement better logging with configurable verbosity
-	Logger *log.Logger
+	// GoodbyeMessage is sent along with the 221 in response to a QUIT, defaults to "Bye"
+	GoodbyeMessage string
 
+	// Metrics, if set, is given measurements of each session
+	Metrics Metrics
+
+	// Now is the server's clock, used for timestamps (e.g. the banner date & Received
+	// headers), CRAM-MD5 challenges, generated message IDs and message pacing. Defaults
+	// to time.Now
+	Now func() time.Time
+
+	// Logger to print out status info, filtered by LogLevel. NewServer logs at LogInfo
+	Logger   Logger
+	LogLevel LogLevel
+
+	// Verbose logs every command received, as LogDebug does
 	Verbose bool
 
+	// ResponseRewriter, if set, is applied to every response code & message
+	// before it is written to the client, for interop with legacy systems
+	ResponseRewriter func(code int, msg string) (int, string)
+
 	// Timeout handlers
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// GreetDelay holds back the banner for a while to catch clients that start talking
+	// before they've been greeted, which RejectPreGreet turns away with a 554
+	GreetDelay     time.Duration
+	RejectPreGreet bool
+
+	// GreetingTimeout, if set, overrides ReadTimeout for the first command after the banner
+	GreetingTimeout time.Duration
+
+	// CommandTimeouts overrides ReadTimeout for any reads made while handling
+	// the given verb, e.g. a longer window for the DATA body
+	CommandTimeouts map[string]time.Duration
+
+	// MaxIdle is a safety net for connections that go quiet without being timed out,
+	// e.g. due to a stuck handler. Any connection with nothing read from it for longer
+	// is closed by a background reaper. It should be well over the longest read timeout,
+	// zero to disable
+	MaxIdle time.Duration
+
 	// Ready is a channel that will receive a single `true` when the server has started
 	Ready chan bool
+
+	// connections currently being handled, tracked for the idle reaper
+	activeLock sync.Mutex
+	active     map[*Conn]struct{}
+
+	// sessions counts the running HandleSMTP goroutines, for Shutdown to wait on
+	sessions     sync.WaitGroup
+	shuttingDown int32
 }
 
 // NewServer creates a server with the default settings
@@ -85,29 +335,96 @@ func NewServer(handler func(*Message) error) *Server {
 }
 
 // NewServerWithLogger creates a server with a customer logger
-func NewServerWithLogger(handler func(*Message) error, logger *log.Logger) *Server {
+func NewServerWithLogger(handler func(*Message) error, logger Logger) *Server {
 	name, err := os.Hostname()
 	if err != nil {
 		name = "localhost"
 	}
 	return &Server{
-		Name:         name,
-		ServerName:   name,
-		MaxSize:      DefaultMessageSizeMax,
-		MaxCommands:  DefaultSessionCommandsMax,
-		Handler:      handler,
-		Extensions:   make(map[string]Extension),
-		Disabled:     make(map[string]bool),
-		Logger:       logger,
-		ReadTimeout:  DefaultReadTimeout,
-		WriteTimeout: DefaultWriteTimeout,
-		Ready:        make(chan bool, 1),
+		Hostname:        name,
+		Name:            name,
+		ServerName:      name,
+		defaultHostname: name,
+		MaxSize:         DefaultMessageSizeMax,
+		MaxCommands:     DefaultSessionCommandsMax,
+		MaxHeloLength:   DefaultHeloLengthMax,
+		MaxLineLength:   DefaultLineLengthMax,
+		AllowNullSender: true,
+		Handler:         handler,
+		Extensions:      make(map[string]Extension),
+		Disabled:        make(map[string]bool),
+		Logger:          logger,
+		LogLevel:        LogInfo,
+		ReadTimeout:     DefaultReadTimeout,
+		WriteTimeout:    DefaultWriteTimeout,
+		MessageBuffer:   DefaultMessageBuffer,
+		MessageTimeout:  DefaultMessageTimeout,
+		DNSTimeout:      DefaultDNSTimeout,
+		TarpitDelay:     DefaultTarpitDelay,
+		TarpitMax:       DefaultTarpitMax,
+		Ready:           make(chan bool, 1),
 	}
 }
 
 // Close the server connection
 func (s *Server) Close() error {
-	return (*s.listener).Close()
+	return (*s.currentListener()).Close()
+}
+
+// currentListener is the listener connections are being accepted from, if any
+func (s *Server) currentListener() *net.Listener {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	return s.listener
+}
+
+// Shutdown stops accepting new connections and waits for the sessions already in
+// progress to finish, or for ctx to expire, whichever comes first
+func (s *Server) Shutdown(ctx context.Context) error {
+	// once the flag is set under the lock no more sessions are started, so
+	// none can be added to the WaitGroup while it's being waited on
+	s.listenerLock.Lock()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	listener := s.listener
+	s.listenerLock.Unlock()
+
+	if listener != nil {
+		if err := (*listener).Close(); err != nil {
+			return err
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// now reads the server's clock
+func (s *Server) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// hostname is the name the server identifies itself by: Hostname, unless it's been left
+// at its default and one of the deprecated aliases hasn't
+func (s *Server) hostname() string {
+	for _, name := range []string{s.Hostname, s.ServerName, s.Name} {
+		if name != "" && name != s.defaultHostname {
+			return name
+		}
+	}
+	return s.defaultHostname
 }
 
 // Greeting is a humanized response to EHLO to precede the list of available commands
@@ -115,6 +432,69 @@ func (s *Server) Greeting(conn *Conn) string {
 	return fmt.Sprintf("Welcome! [%v]", conn.LocalAddr())
 }
 
+// helloLine builds the first line of the reply to HELO/EHLO, echoing the client's
+// name & address back to it if EchoClient is set
+func (s *Server) helloLine(conn *Conn, greeting string) string {
+	if s.EchoClient {
+		return fmt.Sprintf("%v Hello %v [%v]", s.hostname(), conn.HeloHost, conn.remoteIP())
+	}
+	return fmt.Sprintf("%v %v", s.hostname(), greeting)
+}
+
+// Capabilities lists the EHLO keywords that would be advertised to the supplied
+// connection in its current state, in the order they're written
+func (s *Server) Capabilities(conn *Conn) []string {
+	if s.RequireTLS && !conn.IsTLS && s.TLSConfig != nil {
+		// nothing else is usable until the client upgrades
+		return s.enabledCapabilities([]string{"STARTTLS", "HELP"})
+	}
+
+	capabilities := []string{fmt.Sprintf("SIZE %v", s.MaxSize)}
+	if !conn.IsTLS && s.TLSConfig != nil {
+		capabilities = append(capabilities, "STARTTLS")
+	}
+	capabilities = append(capabilities, "PIPELINING", "8BITMIME", "CHUNKING", "DSN")
+	if s.SMTPUTF8 {
+		capabilities = append(capabilities, "SMTPUTF8")
+	}
+	if conn.User == nil && s.Auth != nil {
+		capabilities = append(capabilities, fmt.Sprintf("AUTH %v", s.Auth.EHLO()))
+	}
+	if s.EnhancedStatusCodes {
+		capabilities = append(capabilities, "ENHANCEDSTATUSCODES")
+	}
+
+	if s.TrustXForward != nil && s.TrustXForward(conn) {
+		capabilities = append(capabilities, "XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE")
+	}
+
+	// sorted so the advertisement is stable between sessions
+	verbs := make([]string, 0, len(s.Extensions))
+	for verb := range s.Extensions {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	for _, verb := range verbs {
+		capabilities = append(capabilities, fmt.Sprintf("%v %v", verb, s.Extensions[verb].EHLO()))
+	}
+
+	return s.enabledCapabilities(append(capabilities, "HELP"))
+}
+
+// enabledCapabilities filters out the EHLO keywords that have been disabled, CHUNKING
+// going along with the BDAT command it introduces
+func (s *Server) enabledCapabilities(capabilities []string) []string {
+	enabled := make([]string, 0, len(capabilities))
+	for _, capability := range capabilities {
+		keyword := strings.Fields(capability)[0]
+		if s.Disabled[keyword] || (keyword == "CHUNKING" && s.Disabled["BDAT"]) {
+			continue
+		}
+		enabled = append(enabled, capability)
+	}
+	return enabled
+}
+
 // Extend the server to handle the supplied verb
 func (s *Server) Extend(verb string, extension Extension) error {
 	if _, ok := s.Extensions[verb]; ok {
@@ -145,12 +525,34 @@ func (s *Server) UseTLS(cert, key string) error {
 	if err != nil {
 		return fmt.Errorf("Could not load TLS keypair, %v", err)
 	}
-	s.TLSConfig = &tls.Config{
+	config := &tls.Config{
 		Certificates: []tls.Certificate{c},
 		ClientAuth:   tls.VerifyClientCertIfGiven,
 		Rand:         rand.Reader,
-		ServerName:   s.ServerName,
+		ServerName:   s.hostname(),
+	}
+
+	// the Hostname may well be set after the keypair's loaded, so the name is looked
+	// up again for each handshake. This goes by s.TLSConfig, so the callback carries
+	// over to any copy of the config that's put in its place
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		current := s.TLSConfig.Clone()
+		current.GetConfigForClient = nil
+		current.ServerName = s.hostname()
+		return current, nil
+	}
+
+	s.TLSConfig = config
+	return nil
+}
+
+// SetALPN configures the ALPN protocols offered during TLS negotiation, call with no
+// protocols to disable ALPN so SMTP over TLS isn't mistaken for HTTP/2 by intermediaries
+func (s *Server) SetALPN(protocols ...string) error {
+	if s.TLSConfig == nil {
+		return ErrTLSNotConfigured
 	}
+	s.TLSConfig.NextProtos = protocols
 	return nil
 }
 
@@ -159,19 +561,44 @@ func (s *Server) UseAuth(auth Extension) {
 	s.Auth = auth
 }
 
-// SetHelp sets a help message
+// SetHelp sets a help message, which may span multiple lines
 func (s *Server) SetHelp(message string) error {
-	if len(message) > 100 || strings.TrimSpace(message) == "" {
-		return fmt.Errorf("Message '%v' is not a valid HELP message. Must be less than 100 characters and non-empty", message)
+	if strings.TrimSpace(message) == "" {
+		return fmt.Errorf("Message '%v' is not a valid HELP message. Must be non-empty", message)
+	}
+	for _, line := range helpLines(message) {
+		if len(line) > MaxReplyLineLength {
+			return fmt.Errorf("Message '%v' is not a valid HELP message. Lines must be at most %v characters", message, MaxReplyLineLength)
+		}
 	}
 	s.Help = message
 	return nil
 }
 
+// helpLines splits a help message into the lines of a multiline reply
+func helpLines(message string) []string {
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return lines
+}
+
 // ListenAndServe starts listening for SMTP commands at the supplied TCP address
 func (s *Server) ListenAndServe(addr string) error {
+	return s.listenAndServe(addr, false)
+}
 
-	if s.listener != nil {
+// ListenAndServeTLS starts listening for SMTP commands at the supplied TCP address,
+// with each connection encrypted from the start using the TLSConfig, as on port 465
+// see: https://tools.ietf.org/html/rfc8314#section-3.3
+func (s *Server) ListenAndServeTLS(addr string) error {
+	return s.listenAndServe(addr, true)
+}
+
+func (s *Server) listenAndServe(addr string, implicitTLS bool) error {
+
+	if s.currentListener() != nil {
 		return ErrAlreadyRunning
 	}
 
@@ -180,25 +607,81 @@ func (s *Server) ListenAndServe(addr string) error {
 		close(s.Ready)
 	}()
 
+	// a server requiring STARTTLS it can't offer would never accept any mail
+	if (implicitTLS || s.RequireTLS) && s.TLSConfig == nil {
+		s.logf(LogError, "Cannot listen on %v (%v)", addr, ErrTLSNotConfigured)
+		return ErrTLSNotConfigured
+	}
+
 	// Start listening for SMTP connections
-	listener, err := net.Listen("tcp", addr)
+	listenConfig := s.ListenConfig
+	if listenConfig == nil {
+		listenConfig = &net.ListenConfig{}
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", addr)
 	if err != nil {
-		s.Logger.Printf("Cannot listen on %v (%v)", addr, err)
+		s.logf(LogError, "Cannot listen on %v (%v)", addr, err)
 		return err
 	}
+	if implicitTLS {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+
+	s.listenerLock.Lock()
+	s.replaced = make(chan struct{}, 1)
+	first := listener
+	current := &first
+	s.listener = current
+	s.listenerLock.Unlock()
+
 	s.Ready <- true
 
-	var clientID int64 = 1
+	// whichever way the server stops, anyone ranging over Messages is let go
+	defer func() {
+		go s.closeMessages()
+	}()
 
-	s.listener = &listener
+	var clientID int64 = 1
 
-	// @TODO maintain a fixed-size connection pool, throw immediate 554s otherwise
+	// slots is a fixed-size pool of connections, if MaxConn is set
 	// see http://www.greenend.org.uk/rjk/tech/smtpreplies.html
 	// maybe also pass around a context? https://blog.golang.org/context
+	var slots chan struct{}
+	if s.MaxConn > 0 {
+		slots = make(chan struct{}, s.MaxConn)
+	}
+
+	if s.MaxIdle > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.reapIdle(done)
+	}
+
 	for {
 
 		conn, err := listener.Accept()
 
+		if err != nil {
+			select {
+			case <-s.replaced:
+				// the listener was closed by ReplaceListener, carry on with the new one
+				if next := s.currentListener(); next != current {
+					current, listener = next, *next
+					if implicitTLS {
+						listener = tls.NewListener(listener, s.TLSConfig)
+					}
+				}
+				continue
+			default:
+			}
+		}
+
+		if err != nil && atomic.LoadInt32(&s.shuttingDown) == 1 {
+			// the listener was closed by Shutdown
+			return nil
+		}
+
 		if netErr, ok := err.(*net.OpError); ok && netErr.Timeout() {
 			// it was a timeout
 			continue
@@ -207,54 +690,497 @@ func (s *Server) ListenAndServe(addr string) error {
 		}
 
 		if err != nil {
-			log.Println("Could not handle request:", err)
+			s.logf(LogError, "Could not handle request: %v", err)
 			continue
 		}
 
 		c := &Conn{
-			Conn: conn,
-			// TODO: implement ListenAndServeSSL for :465 servers
-			IsTLS:        false,
-			Errors:       []error{},
-			MaxSize:      s.MaxSize,
-			ReadTimeout:  s.ReadTimeout,
-			WriteTimeout: s.WriteTimeout,
+			Conn:          conn,
+			IsTLS:         implicitTLS,
+			Errors:        []error{},
+			MaxSize:       s.MaxSize,
+			MaxDataLines:  s.MaxDataLines,
+			MaxLineLength: s.MaxLineLength,
+			ReadTimeout:   s.ReadTimeout,
+			WriteTimeout:  s.WriteTimeout,
+			Rewriter:      s.ResponseRewriter,
+			lookupAddr:    s.lookupAddr,
+			clock:         s.now,
 		}
 
 		c.SetReadDeadline(time.Now().Add(s.ReadTimeout))
 		c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
 
-		go s.HandleSMTP(c)
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				msg := DefaultOverloadMessage
+				if s.OverloadMessage != "" {
+					msg = s.OverloadMessage
+				}
+				// on an implicit TLS listener the write means a handshake, which mustn't hold up accepting
+				go func() {
+					c.WriteSMTP(554, msg)
+					c.Flush()
+					c.Close()
+				}()
+				continue
+			}
+		}
+
+		s.listenerLock.Lock()
+		if atomic.LoadInt32(&s.shuttingDown) == 1 {
+			// accepted just as Shutdown began, it's too late to start a session
+			s.listenerLock.Unlock()
+			if slots != nil {
+				<-slots
+			}
+			c.Close()
+			return nil
+		}
+		s.sessions.Add(1)
+		s.listenerLock.Unlock()
+
+		go func() {
+			defer s.sessions.Done()
+			s.HandleSMTP(c)
+			if slots != nil {
+				<-slots
+			}
+		}()
 		clientID++
 
 	}
 }
 
+// ReplaceListener binds a new listener at addr and switches over to accepting connections
+// from it, closing the old one. Sessions already in progress carry on undisturbed
+func (s *Server) ReplaceListener(addr string) error {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	if s.listener == nil {
+		return fmt.Errorf("This server isn't listening for requests")
+	}
+
+	listenConfig := s.ListenConfig
+	if listenConfig == nil {
+		listenConfig = &net.ListenConfig{}
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		s.logf(LogError, "Cannot listen on %v (%v)", addr, err)
+		return err
+	}
+
+	// the replacement has to be in place before the old listener's Accept fails. The
+	// accept loop picks up whichever listener is current, so a signal that's already
+	// pending covers this one too
+	old := s.listener
+	s.listener = &listener
+	select {
+	case s.replaced <- struct{}{}:
+	default:
+	}
+	return (*old).Close()
+}
+
 // Address retrieves the address of the server
 func (s *Server) Address() string {
-	if s.listener != nil {
-		return (*s.listener).Addr().String()
+	if listener := s.currentListener(); listener != nil {
+		return (*listener).Addr().String()
 	}
 	return ""
 }
 
+// readTimeout looks up the read timeout to use while handling the supplied verb
+func (s *Server) readTimeout(verb string) time.Duration {
+	if timeout, ok := s.CommandTimeouts[verb]; ok {
+		return timeout
+	}
+	return s.ReadTimeout
+}
+
+// checkHelo validates the argument to HELO/EHLO, replying with a 501 if it's refused
+func (s *Server) checkHelo(conn *Conn, verb, args string) bool {
+	host := strings.TrimSpace(args)
+	if host == "" {
+		conn.WriteSMTP(501, fmt.Sprintf("Syntax: %v hostname", verb))
+		return false
+	} else if s.MaxHeloLength > 0 && len(host) > s.MaxHeloLength {
+		conn.WriteSMTP(501, "Domain name too long")
+		return false
+	} else if s.ValidateHelo && !validHeloHost(host) {
+		conn.WriteSMTP(501, "Invalid domain name")
+		return false
+	}
+	return true
+}
+
+// validHeloHost checks that host is syntactically a domain or an address literal,
+// see https://tools.ietf.org/html/rfc5321#section-4.1.3
+func validHeloHost(host string) bool {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		literal := host[1 : len(host)-1]
+		if strings.HasPrefix(strings.ToUpper(literal), "IPV6:") {
+			ip := net.ParseIP(literal[5:])
+			return ip != nil && ip.To4() == nil
+		}
+		ip := net.ParseIP(literal)
+		return ip != nil && ip.To4() != nil
+	}
+	return heloDomainRegex.MatchString(strings.TrimSuffix(host, "."))
+}
+
+var heloDomainRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// contentRegex matches the start of a header field, or a MIME boundary line
+var contentRegex = regexp.MustCompile(`^([!-9;-~]+:|--)`)
+
+// looksLikeContent reports whether what was read as a verb looks more like a line
+// of a message, i.e. a header field or a MIME boundary
+func looksLikeContent(verb string) bool {
+	return contentRegex.MatchString(verb)
+}
+
+// redactArgs hides anything secret in a command's arguments before they're logged, i.e.
+// the credentials that can accompany AUTH. Responses to the mechanism's own challenges
+// are read directly by the AuthExtension, so never reach the command log
+func redactArgs(verb, args string) string {
+	if verb != "AUTH" {
+		return args
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) > 1 {
+		return fmt.Sprintf("%v [credentials redacted]", fields[0])
+	}
+	return args
+}
+
+// maxBadCommands is the number of unrecognized commands a client may send before
+// it's disconnected, or tarpitted if BadCommandTarpit is set
+const maxBadCommands = 3
+
+// tarpitDelay works out how long to hold back the next reply to a client that's
+// sent too many unrecognized commands, zero if it shouldn't be delayed
+func (s *Server) tarpitDelay(conn *Conn) time.Duration {
+	excess := len(conn.Errors) - maxBadCommands
+	if !s.BadCommandTarpit || excess <= 0 || s.TarpitDelay <= 0 {
+		return 0
+	}
+
+	delay := s.TarpitDelay
+	for i := 1; i < excess; i++ {
+		delay *= 2
+		if s.TarpitMax > 0 && delay >= s.TarpitMax {
+			return s.TarpitMax
+		}
+	}
+	if s.TarpitMax > 0 && delay > s.TarpitMax {
+		return s.TarpitMax
+	}
+	return delay
+}
+
+// messageLimitReached checks whether the connection has sent too many messages, or is sending them too quickly
+func (s *Server) messageLimitReached(conn *Conn) bool {
+	if s.MaxMessagesPerConn > 0 && conn.messages >= s.MaxMessagesPerConn {
+		return true
+	}
+	return s.MessageInterval > 0 && !conn.lastMessage.IsZero() && s.now().Sub(conn.lastMessage) < s.MessageInterval
+}
+
+// attachmentsTooLarge checks the combined size of the message's decoded attachments against MaxAttachmentBytes
+func (s *Server) attachmentsTooLarge(m *Message) bool {
+	if s.MaxAttachmentBytes <= 0 {
+		return false
+	}
+
+	// messages we can't find attachments in are left for the handler to deal with
+	attachments, err := m.Attachments()
+	if err != nil {
+		return false
+	}
+
+	var total int64
+	for _, attachment := range attachments {
+		total += int64(len(attachment.Body))
+	}
+	return total > s.MaxAttachmentBytes
+}
+
+// isSpam scores the message with the ScoreFunc, if any, reporting whether it meets the RejectScore
+func (s *Server) isSpam(m *Message) (float64, bool) {
+	if s.ScoreFunc == nil {
+		return 0, false
+	}
+
+	score, err := s.ScoreFunc(m)
+	if err != nil {
+		// don't hold up mail just because the scorer is having trouble
+		s.logf(LogError, "Could not score message %v: %v", m.ID(), err)
+		return 0, false
+	}
+	return score, score >= s.RejectScore
+}
+
+// AddHandler adds another handler to be run, in order, after Handler
+func (s *Server) AddHandler(handler MessageHandler) {
+	s.handlersLock.Lock()
+	defer s.handlersLock.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Messages returns a channel that every accepted message is also delivered to, as an
+// alternative to writing a handler. It's set up as a handler on first use, so MessageBuffer
+// and MessageTimeout need to be configured beforehand. A consumer that falls behind doesn't
+// hold up the session, messages it has no room for are rejected with a 451 instead.
+// The channel is closed once the server has stopped and its sessions have finished
+func (s *Server) Messages() <-chan *Message {
+	s.messagesOnce.Do(func() {
+		s.messagesLock.Lock()
+		s.messages = make(chan *Message, s.MessageBuffer)
+		if s.messagesClosed {
+			close(s.messages)
+		}
+		s.messagesLock.Unlock()
+
+		s.AddHandler(func(m *Message) error {
+			s.messagesLock.RLock()
+			defer s.messagesLock.RUnlock()
+
+			if s.messagesClosed {
+				return NewError(451, "Mailbox busy, try again later")
+			}
+
+			select {
+			case s.messages <- m:
+				return nil
+			case <-time.After(s.MessageTimeout):
+				return NewError(451, "Mailbox busy, try again later")
+			}
+		})
+	})
+	return s.messages
+}
+
+// closeMessages closes the Messages channel, if there is one, once the sessions still
+// in progress have finished with it
+func (s *Server) closeMessages() {
+	s.sessions.Wait()
+
+	s.messagesLock.Lock()
+	defer s.messagesLock.Unlock()
+
+	if !s.messagesClosed && s.messages != nil {
+		close(s.messages)
+	}
+	s.messagesClosed = true
+}
+
+// handleMessage fans the message out to each of the handlers in turn, the first
+// one to return an error stops the message going any further
 func (s *Server) handleMessage(m *Message) error {
-	return s.Handler(m)
+	s.handlersLock.RLock()
+	handlers := append([]MessageHandler(nil), s.handlers...)
+	s.handlersLock.RUnlock()
+
+	if s.Handler == nil && len(handlers) == 0 {
+		// there's nowhere for the message to go, better the client knows than it's lost
+		return ErrNoHandler
+	}
+
+	if s.Handler != nil {
+		handlers = append([]MessageHandler{s.Handler}, handlers...)
+	}
+
+	// the last handler to give a result of its own gets its reply sent
+	var result error
+	for _, handler := range handlers {
+		err := s.recipientOutcome(m, handler(m))
+		if _, ok := err.(HandlerResult); ok {
+			result = err
+		} else if err != nil {
+			return err
+		}
+	}
+	return result
+}
+
+// recipientOutcome settles a handler's RecipientErrors into a single result, as there's
+// only the one reply to DATA: the message is accepted if any recipient succeeded, with
+// the failures logged, otherwise it's rejected with the worst of the recipients' codes.
+// Any other error is passed through as is
+func (s *Server) recipientOutcome(m *Message, err error) error {
+	errs, ok := err.(RecipientErrors)
+	if !ok {
+		return err
+	}
+
+	worst := SMTPError{}
+	delivered := false
+	for _, rcpt := range m.rcpt {
+		rerr, failed := errs[rcpt.Address]
+		if !failed || rerr == nil {
+			delivered = true
+			continue
+		}
+
+		serr, ok := rerr.(SMTPError)
+		if !ok {
+			serr = SMTPError{Code: 554, Err: rerr}
+		}
+		if serr.Code > worst.Code {
+			worst = serr
+		}
+	}
+
+	if !delivered && worst.Code != 0 {
+		return worst
+	}
+
+	for address, rerr := range errs {
+		if rerr != nil {
+			s.logf(LogInfo, "Message %v not delivered to %v: %v", m.ID(), address, rerr)
+		}
+	}
+	return nil
+}
+
+// talksBeforeGreeting waits out the GreetDelay, reporting whether the client sent anything
+// in the meantime. Anything it did send is left buffered for the command loop
+func (s *Server) talksBeforeGreeting(conn *Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(s.GreetDelay))
+	_, err := conn.tp().R.Peek(1)
+	return err == nil
+}
+
+// track adds or removes conn from the set of connections being handled
+func (s *Server) track(conn *Conn, active bool) {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	if s.active == nil {
+		s.active = make(map[*Conn]struct{})
+	}
+	if active {
+		s.active[conn] = struct{}{}
+	} else {
+		delete(s.active, conn)
+	}
+}
+
+// reapIdle periodically closes any connection that's been idle for longer than MaxIdle,
+// until done is closed
+func (s *Server) reapIdle(done chan struct{}) {
+	// tiny MaxIdle values would otherwise spin, or panic once the interval rounds to zero
+	interval := s.MaxIdle / 4
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		s.activeLock.Lock()
+		for conn := range s.active {
+			if idle := conn.idle(); idle > s.MaxIdle {
+				s.logf(LogInfo, "Closing connection from %v after %v idle", conn.RemoteAddr(), idle)
+				conn.Close()
+				delete(s.active, conn)
+			}
+		}
+		s.activeLock.Unlock()
+	}
 }
 
 // HandleSMTP handles a single SMTP request
 func (s *Server) HandleSMTP(conn *Conn) error {
-	defer conn.Close()
-	conn.WriteSMTP(220, fmt.Sprintf("%v %v", s.Name, time.Now().Format(time.RFC1123Z)))
+	conn.touch()
+	s.track(conn, true)
+
+	// conn may be replaced mid-session (e.g. by STARTTLS), so close whichever is current
+	defer func() {
+		s.track(conn, false)
+		conn.Flush()
+		conn.Close()
+		if s.OnClose != nil {
+			s.OnClose(conn)
+		}
+	}()
+
+	if s.GreetDelay > 0 && s.talksBeforeGreeting(conn) {
+		s.logf(LogInfo, "%v sent data before the greeting", conn.RemoteAddr())
+		if s.RejectPreGreet {
+			conn.WriteSMTP(554, "SMTP synchronization error")
+			return nil
+		}
+	}
+
+	if zone := s.blocklisted(conn); zone != "" {
+		s.logf(LogInfo, "%v is listed in %v", conn.RemoteAddr(), zone)
+		conn.WriteSMTP(554, fmt.Sprintf("Client [%v] blocked using %v", conn.remoteIP(), zone))
+		return nil
+	}
+
+	if s.ConnectionHandler != nil {
+		if err := s.ConnectionHandler(conn); err != nil {
+			s.logf(LogInfo, "Refused connection from %v: %v", conn.RemoteAddr(), err)
+			if serr, ok := err.(SMTPError); ok {
+				conn.WriteError(serr)
+			} else {
+				conn.WriteSMTP(554, err.Error())
+			}
+			return nil
+		}
+	}
+
+	conn.WriteSMTP(220, fmt.Sprintf("%v %v", s.hostname(), s.now().Format(time.RFC1123Z)))
+
+	if s.RateLimiter != nil && !s.RateLimiter(conn) {
+		s.logf(LogInfo, "Rate limited %v", conn.RemoteAddr())
+		conn.WriteSMTP(421, "Service not available, closing transmission channel")
+		return nil
+	}
+
+	// each command is timed until its reply has been written, which is just before the
+	// next is read. Replies held back to be batched with those to pipelined commands are
+	// timed to when they're queued
+	timer := &commandTimer{}
+	defer func() {
+		conn.Flush()
+		s.finishCommand(timer)
+	}()
 
 ReadLoop:
 	for i := 0; i < s.MaxCommands; i++ {
+		// a write error sticks, so it surfaces from ReadSMTP below
+		conn.flushIfIdle()
+		s.finishCommand(timer)
 
 		var verb, args string
 		var err error
 
-		if verb, args, err = conn.ReadSMTP(); err != nil {
-			s.Logger.Printf("Read error: %v", err)
+		conn.ReadTimeout = s.ReadTimeout
+		if i == 0 && s.GreetingTimeout > 0 {
+			// clients that connect and then never speak shouldn't get the full ReadTimeout
+			conn.ReadTimeout = s.GreetingTimeout
+		}
+
+		if verb, args, err = conn.ReadSMTP(); err == ErrCommandTooLong {
+			conn.WriteError(ErrCommandTooLong)
+			continue
+		} else if err != nil {
+			s.logf(LogInfo, "Read error: %v", err)
 			if err == io.EOF {
 				// client closed the connection already
 				break ReadLoop
@@ -267,12 +1193,33 @@ ReadLoop:
 			return err
 		}
 
-		if s.Verbose {
-			s.Logger.Printf("%v %v", verb, args)
+		if s.Verbose || s.LogLevel >= LogDebug {
+			s.Logger.Printf("%v %v", verb, redactArgs(verb, args))
+		}
+		timer.verb, timer.started = verb, time.Now()
+
+		conn.ReadTimeout = s.readTimeout(verb)
+
+		if delay := s.tarpitDelay(conn); delay > 0 {
+			time.Sleep(delay)
+		}
+
+		// a BDAT chunk follows its command whether or not it's accepted, so a refused
+		// one still has to be read off the wire, lest its content be taken for commands
+		skipChunk := func() {
+			if verb != "BDAT" {
+				return
+			}
+			if size, _, err := parseBDAT(args); err == nil {
+				if err := conn.discardChunk(size); err != nil {
+					s.logf(LogInfo, "BDAT read error: %v", err)
+				}
+			}
 		}
 
 		// Always check for disabled features first
 		if s.Disabled[verb] {
+			skipChunk()
 			if verb == "EHLO" {
 				conn.WriteSMTP(550, "Not implemented")
 			} else {
@@ -281,6 +1228,26 @@ ReadLoop:
 			continue
 		}
 
+		// TLS-only servers won't let a transaction start in the clear
+		if s.RequireTLS && !conn.IsTLS {
+			switch verb {
+			case "MAIL", "RCPT", "DATA", "BDAT":
+				skipChunk()
+				conn.WriteEnhanced(530, "5.7.0", "Must issue a STARTTLS command first")
+				continue
+			}
+		}
+
+		// Message content out of place is a sign of an attempt at smuggling a second
+		// message past us, so it's not safe to carry on. This comes ahead of the auth
+		// check so that an unauthenticated client can't hide it behind a 530
+		if _, ok := s.Extensions[verb]; !ok && s.StrictCommands && looksLikeContent(verb) {
+			conn.Errors = append(conn.Errors, fmt.Errorf("bad input: %v %v", verb, args))
+			s.logf(LogInfo, "%v sent message content outside of DATA: %v", conn.RemoteAddr(), verb)
+			conn.WriteEnhanced(554, "5.5.0", "Message content outside of DATA, closing connection")
+			break ReadLoop
+		}
+
 		// Auth overrides
 		if s.Auth != nil && conn.User == nil {
 			switch verb {
@@ -290,16 +1257,23 @@ ReadLoop:
 				conn.WriteSMTP(501, "Cancelled")
 				continue
 			default:
-				conn.WriteSMTP(530, "Authentication required")
+				skipChunk()
+				required := ErrAuthRequired
+				if s.AuthRequiredResponse.Code != 0 {
+					required = s.AuthRequiredResponse
+				}
+				conn.WriteError(required)
 				continue
 			}
 		}
 
-		// Handle any extensions / overrides before running default logic
+		// Handle any extensions / overrides before running default logic. An override
+		// of BDAT reads its own chunk, unless it fails
 		if _, ok := s.Extensions[verb]; ok {
 			err := s.Extensions[verb].Handle(conn, args)
 			if err != nil {
-				s.Logger.Printf("Error? %v", err)
+				skipChunk()
+				s.logf(LogError, "Error? %v", err)
 			}
 			continue
 		}
@@ -307,32 +1281,77 @@ ReadLoop:
 		switch verb {
 		// https://tools.ietf.org/html/rfc2821#section-4.1.1.1
 		case "HELO":
-			conn.WriteSMTP(250, fmt.Sprintf("%v Hello", s.ServerName))
+			if !s.checkHelo(conn, verb, args) {
+				continue
+			}
+			conn.HeloHost, conn.ehlo, conn.enhanced = strings.TrimSpace(args), false, false
+			conn.WriteSMTP(250, s.helloLine(conn, "Hello"))
 		case "EHLO":
+			if !s.checkHelo(conn, verb, args) {
+				continue
+			}
+
 			// see: https://tools.ietf.org/html/rfc2821#section-4.1.4
 			conn.Reset()
-
-			conn.WriteEHLO(fmt.Sprintf("%v %v", s.ServerName, s.Greeting(conn)))
-			conn.WriteEHLO(fmt.Sprintf("SIZE %v", s.MaxSize))
-			if !conn.IsTLS && s.TLSConfig != nil {
-				conn.WriteEHLO("STARTTLS")
-			}
-			if conn.User == nil && s.Auth != nil {
-				conn.WriteEHLO(fmt.Sprintf("AUTH %v", s.Auth.EHLO()))
+			conn.HeloHost, conn.ehlo = strings.TrimSpace(args), true
+
+			// the EHLO reply itself never carries enhanced status codes
+			conn.enhanced = false
+			lines := []string{s.helloLine(conn, s.Greeting(conn))}
+			for _, capability := range s.Capabilities(conn) {
+				if len(capability) > MaxReplyLineLength {
+					s.logf(LogInfo, "Not advertising over-long EHLO capability %.32v...", capability)
+					continue
+				}
+				lines = append(lines, capability)
 			}
-			for verb, extension := range s.Extensions {
-				conn.WriteEHLO(fmt.Sprintf("%v %v", verb, extension.EHLO()))
+			for _, line := range lines[:len(lines)-1] {
+				conn.WriteEHLO(line)
 			}
-			conn.WriteSMTP(250, "HELP")
+			conn.WriteSMTP(250, lines[len(lines)-1])
+			conn.enhanced = s.EnhancedStatusCodes
 		// The MAIL command starts off a new mail transaction
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.2
 		// This doesn't implement the RFC4594 addition of an AUTH param to the MAIL command
 		// see: http://tools.ietf.org/html/rfc4954#section-3 for details
 		case "MAIL":
+			if s.messageLimitReached(conn) {
+				conn.WriteSMTP(452, "Too many messages")
+				continue
+			}
+
+			params := parseParams(args)
+			body, err := s.bodyType(params)
+			if err != nil {
+				conn.WriteSMTP(501, err.Error())
+				continue
+			}
+
+			dsn, err := parseMailDSN(params)
+			if err != nil {
+				conn.WriteSMTP(501, err.Error())
+				continue
+			}
+
+			_, smtputf8 := params["SMTPUTF8"]
+			if smtputf8 && !s.SMTPUTF8 {
+				conn.WriteEnhanced(555, "5.5.4", "SMTPUTF8 not supported")
+				continue
+			}
+
 			if from, err := s.GetAddressArg("FROM", args); err == nil {
-				if conn.User == nil || conn.User.IsUser(from.Address) {
+				if from.Address == "" && !s.AllowNullSender {
+					conn.WriteEnhanced(550, "5.1.7", "Null sender not allowed")
+				} else if !smtputf8 && !isASCII(from.Address) {
+					conn.WriteEnhanced(553, "5.6.7", "Non-ASCII addresses require SMTPUTF8")
+				} else if s.RequireResolvableSender && from.Address != "" && !s.domainResolves(from.Address) {
+					conn.WriteEnhanced(450, "4.1.8", "Sender domain must resolve")
+				} else if conn.User == nil || conn.User.IsUser(from.Address) {
 					if err := conn.StartTX(from); err == nil {
-						conn.WriteSMTP(250, "Accepted")
+						conn.usedExtensions = usedExtensions(conn, params)
+						conn.BodyType = body
+						conn.DSN = dsn
+						conn.WriteEnhanced(250, "2.1.0", "Accepted")
 					} else {
 						conn.WriteSMTP(501, err.Error())
 					}
@@ -346,31 +1365,137 @@ ReadLoop:
 		case "RCPT":
 			// TODO: bubble these up to the message,
 			if to, err := s.GetAddressArg("TO", args); err == nil {
+				if !usesExtension(conn.usedExtensions, "SMTPUTF8") && !isASCII(to.Address) {
+					conn.WriteEnhanced(553, "5.6.7", "Non-ASCII addresses require SMTPUTF8")
+					continue
+				}
+				dsn, err := parseRcptDSN(to, parseParams(args))
+				if err != nil {
+					conn.WriteSMTP(501, err.Error())
+					continue
+				}
+				if s.RcptHandler != nil {
+					if err := s.RcptHandler(conn, to); err != nil {
+						if serr, ok := err.(SMTPError); ok {
+							conn.WriteError(serr)
+						} else {
+							conn.WriteSMTP(550, fmt.Sprintf("Recipient rejected. %v", err))
+						}
+						continue
+					}
+				}
 				conn.ToAddr = append(conn.ToAddr, to)
-				conn.WriteSMTP(250, "Accepted")
+				conn.DSN.Recipients = append(conn.DSN.Recipients, dsn)
+				conn.WriteEnhanced(250, "2.1.5", "Accepted")
 			} else {
 				conn.WriteSMTP(501, err.Error())
 			}
 		// https://tools.ietf.org/html/rfc2821#section-4.1.1.4
 		case "DATA":
+			// there's no sink for a message that's bound to be refused for want of a transaction
+			var sink *dataSink
+			if s.DataSink != nil && conn.transaction != 0 && len(conn.ToAddr) > 0 {
+				if sink, err = s.openDataSink(conn); err != nil {
+					s.logf(LogError, "Could not open DATA sink: %v", err)
+					conn.WriteError(ErrLocalProcessing)
+					continue
+				}
+			}
+
 			conn.WriteSMTP(354, "Enter message, ending with \".\" on a line by itself")
+			conn.Flush()
+
+			var peek func(head []byte) error
+			var rejected error
+			if s.PeekHandler != nil && s.PeekBytes > 0 {
+				peek = func(head []byte) error {
+					rejected = s.PeekHandler(conn, head)
+					return rejected
+				}
+			}
 
-			if data, err := conn.ReadData(); err == nil {
-				if message, err := NewMessage([]byte(data), conn.ToAddr, s.Logger); err == nil && (conn.EndTX() == nil) {
-					if err := s.handleMessage(message); err == nil {
-						conn.WriteSMTP(250, fmt.Sprintf("OK : queued as %v", message.ID()))
-					} else if serr, ok := err.(SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
-					} else {
-						conn.WriteSMTP(554, fmt.Sprintf("Server error while processing SMTP message. %v", err))
-					}
+			var data string
+			var streamed *streamedBody
+			if sink != nil {
+				var buffered *dataBuffer
+				buffered, err = conn.readData(s.PeekBytes, peek, sink)
+				if cerr := sink.Close(); err == nil && cerr != nil {
+					err = ErrLocalProcessing
+				}
+				if sink.err != nil {
+					s.logf(LogError, "Could not write to DATA sink: %v", sink.err)
+				}
+				if err == nil {
+					data = buffered.buf.String()
+					streamed = &streamedBody{sink: sink, skip: int64(len(data)), eightBit: buffered.eightBit}
+				} else {
+					s.discardSink(sink)
+				}
+			} else if peek != nil {
+				data, err = conn.ReadDataWithPeek(s.PeekBytes, peek)
+			} else {
+				data, err = conn.ReadData()
+			}
 
+			if rejected != nil {
+				// the rest of the message is still on its way, so there's no getting
+				// back in sync with the client after this
+				if serr, ok := rejected.(SMTPError); ok {
+					conn.WriteError(serr)
 				} else {
-					conn.WriteSMTP(554, fmt.Sprintf("Error while reading SMTP message data. %v", err))
+					conn.WriteSMTP(554, fmt.Sprintf("Message rejected. %v", rejected))
 				}
+				break ReadLoop
+			}
 
+			if err == nil {
+				if s.deliver(conn, data, "DATA", streamed) == ErrDropConnection {
+					break ReadLoop
+				}
+			} else if serr, ok := err.(SMTPError); ok {
+				// the message went over one of the conn's limits
+				conn.abortTX()
+				conn.WriteError(serr)
+			} else if err == ErrIncompleteData {
+				// the client went away without finishing the message, so there's
+				// nothing to deliver and nobody left to reply to
+				s.logf(LogInfo, "DATA aborted, %v disconnected before the end of the message: %v", conn.RemoteAddr(), err)
+				break ReadLoop
 			} else {
-				s.Logger.Printf("DATA read error: %v", err)
+				s.logf(LogInfo, "DATA read error: %v", err)
+			}
+		// BDAT transfers the message in chunks of an exact size rather than dot-terminated,
+		// so it's binary safe. The chunks are collected up until the LAST one
+		// see: https://tools.ietf.org/html/rfc3030
+		case "BDAT":
+			size, last, err := parseBDAT(args)
+			if err != nil {
+				conn.WriteSMTP(501, err.Error())
+				continue
+			}
+
+			// the chunk is on its way regardless, so it has to be read to stay in sync
+			if err := conn.ReadChunk(size); err != nil {
+				if serr, ok := err.(SMTPError); ok {
+					conn.abortTX()
+					conn.WriteError(serr)
+					continue
+				}
+				s.logf(LogInfo, "BDAT read error: %v", err)
+				break ReadLoop
+			}
+
+			if conn.transaction == 0 {
+				conn.chunks.Reset()
+				conn.WriteSMTP(503, "No mail transaction in progress")
+			} else if !last {
+				conn.WriteSMTP(250, fmt.Sprintf("%v octets received", size))
+			} else {
+				data := conn.chunks.String()
+				conn.chunks.Reset()
+				if s.deliver(conn, data, "BDAT", nil) == ErrDropConnection {
+					break ReadLoop
+				}
 			}
 		// Reset the connection
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.5
@@ -380,10 +1505,22 @@ ReadLoop:
 
 		// Since this is a commonly abused SPAM aid, it's better to just
 		// default to 252 (apparent validity / could not verify). If this is not a concern, then
-		// the full `params` value will be the address to verify, respond with `conn.WriteOK()`
+		// set a Verifier to check the address
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.6
 		case "VRFY":
-			conn.WriteSMTP(252, "But it was worth a shot, right?")
+			address := strings.Trim(strings.TrimSpace(args), "<>")
+			if s.Verifier == nil {
+				conn.WriteSMTP(252, "But it was worth a shot, right?")
+			} else if strings.EqualFold(address, "postmaster") {
+				// every server has to have a postmaster, see https://tools.ietf.org/html/rfc5321#section-4.5.1
+				conn.WriteEnhanced(250, "2.1.5", "<postmaster>")
+			} else if err := s.Verifier(conn, address); err == nil {
+				conn.WriteEnhanced(250, "2.1.5", fmt.Sprintf("<%v>", address))
+			} else if serr, ok := err.(SMTPError); ok {
+				conn.WriteError(serr)
+			} else {
+				conn.WriteEnhanced(550, "5.1.1", "Mailbox unavailable")
+			}
 
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.7
 		case "EXPN":
@@ -391,11 +1528,11 @@ ReadLoop:
 
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.8
 		case "HELP":
-			msg := fmt.Sprintf("contact the owner of %v for more information", s.ServerName)
+			msg := fmt.Sprintf("contact the owner of %v for more information", s.hostname())
 			if s.Help != "" {
 				msg = s.Help
 			}
-			conn.WriteSMTP(214, msg)
+			conn.WriteMultiline(214, helpLines(msg)...)
 
 		// NOOP doesn't do anything. Big surprise
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.9
@@ -405,65 +1542,127 @@ ReadLoop:
 		// Say goodbye and close the connection
 		// see: https://tools.ietf.org/html/rfc2821#section-4.1.1.10
 		case "QUIT":
-			conn.WriteSMTP(221, "Bye")
+			msg := "Bye"
+			if s.GoodbyeMessage != "" {
+				msg = s.GoodbyeMessage
+			}
+			conn.WriteSMTP(221, msg)
 			break ReadLoop
 
 		// https://tools.ietf.org/html/rfc2487
 		case "STARTTLS":
 
+			if conn.IsTLS {
+				conn.WriteSMTP(503, "TLS already active")
+				continue
+			}
+
 			if s.TLSConfig == nil {
 				conn.WriteSMTP(454, "TLS is not available on this server")
 				continue
 			}
 
 			conn.WriteSMTP(220, "Ready to start TLS")
+			conn.Flush()
 
 			// upgrade to TLS
 			tlsConn := tls.Server(conn, s.TLSConfig)
 			if tlsConn == nil {
-				s.Logger.Printf("Couldn't upgrade to TLS")
+				s.logf(LogError, "Couldn't upgrade to TLS")
 				break ReadLoop
 			}
 
 			tlsConn.SetDeadline(time.Now().Add(s.WriteTimeout))
 			if err := tlsConn.Handshake(); err == nil {
+				state := tlsConn.ConnectionState()
+				s.track(conn, false)
 				conn = &Conn{
-					Conn:         tlsConn,
-					IsTLS:        true,
-					User:         conn.User,
-					Errors:       conn.Errors,
-					MaxSize:      conn.MaxSize,
-					ReadTimeout:  s.ReadTimeout,
-					WriteTimeout: s.WriteTimeout,
+					Conn:          tlsConn,
+					IsTLS:         true,
+					TLSState:      &state,
+					User:          conn.User,
+					AuthAttempts:  conn.AuthAttempts,
+					Errors:        conn.Errors,
+					history:       conn.history,
+					messages:      conn.messages,
+					lastMessage:   conn.lastMessage,
+					lookupAddr:    s.lookupAddr,
+					clock:         s.now,
+					MaxSize:       conn.MaxSize,
+					MaxDataLines:  conn.MaxDataLines,
+					MaxLineLength: conn.MaxLineLength,
+					ReadTimeout:   s.ReadTimeout,
+					WriteTimeout:  s.WriteTimeout,
+					Rewriter:      s.ResponseRewriter,
 				}
+				conn.touch()
+				s.track(conn, true)
 			} else {
-				s.Logger.Printf("Could not TLS handshake:%v", err)
+				// the 220 has already gone out, so there's no recovering the plaintext
+				// session at this point, all we can do is hang up
+				s.logf(LogInfo, "Could not TLS handshake with %v: %v", conn.RemoteAddr(), err)
 				break ReadLoop
 			}
 
+		// XFORWARD lets a trusted relay pass along the attributes of the original client
+		// see: http://www.postfix.org/XFORWARD_README.html
+		case "XFORWARD":
+			if s.TrustXForward == nil || !s.TrustXForward(conn) {
+				conn.WriteSMTP(550, "Not authorized")
+				continue
+			}
+
+			attrs, err := parseXForward(args)
+			if err != nil {
+				conn.WriteSMTP(501, err.Error())
+				continue
+			}
+
+			if conn.xforward == nil {
+				conn.xforward = make(map[string]string)
+			}
+			for name, value := range attrs {
+				conn.xforward[name] = value
+			}
+			conn.WriteOK()
+
 		// AUTH uses the configured authentication handler to perform an SMTP-AUTH
 		// as defined by the ESMTP AUTH extension
 		// see: http://tools.ietf.org/html/rfc4954
 		case "AUTH":
 			if conn.User != nil {
 				conn.WriteSMTP(503, "You are already authenticated")
+			} else if s.tlsTooWeakForAuth(conn, args) {
+				s.writeAuthReply(conn, ErrEncryptionTooWeak.Code, ErrEncryptionTooWeak.Error())
 			} else if s.Auth != nil {
 				if err := s.Auth.Handle(conn, args); err != nil {
-					if serr, ok := err.(*SMTPError); ok {
-						conn.WriteSMTP(serr.Code, serr.Error())
+					// failures count across mechanisms, so switching between them doesn't buy more guesses
+					conn.AuthAttempts++
+					if s.MaxAuthAttempts > 0 && conn.AuthAttempts >= s.MaxAuthAttempts {
+						s.writeAuthReply(conn, 421, "Too many failed authentication attempts")
+						break ReadLoop
+					}
+
+					if serr, ok := err.(SMTPError); ok {
+						s.writeAuthReply(conn, serr.Code, serr.Error())
+					} else if serr, ok := err.(*SMTPError); ok {
+						s.writeAuthReply(conn, serr.Code, serr.Error())
 					} else {
 						conn.WriteSMTP(500, "Authentication failed")
 					}
 				} else {
-					conn.WriteSMTP(235, "Authentication succeeded")
+					if s.OnAuthSuccess != nil {
+						s.OnAuthSuccess(conn, conn.User)
+					}
+					s.writeAuthReply(conn, 235, "Authentication succeeded")
 				}
 			} else {
 				conn.WriteSMTP(502, "Command not implemented")
 			}
 		default:
-			conn.WriteSMTP(500, "Syntax error, command unrecognised")
 			conn.Errors = append(conn.Errors, fmt.Errorf("bad input: %v %v", verb, args))
-			if len(conn.Errors) > 3 {
+			conn.WriteSMTP(500, "Syntax error, command unrecognised")
+			if len(conn.Errors) > maxBadCommands && !s.BadCommandTarpit {
 				conn.WriteSMTP(500, "Too many unrecognized commands")
 				break ReadLoop
 			}
@@ -475,8 +1674,303 @@ ReadLoop:
 	return nil
 }
 
+// deliver builds a message from the data transferred by method (i.e. DATA or BDAT),
+// runs it past the checks & handlers and replies to the client. ErrDropConnection
+// is returned when the session should be ended. A message that was streamed to the
+// DataSink comes with only its header in data
+func (s *Server) deliver(conn *Conn, data string, method string, streamed *streamedBody) error {
+	// a streamed message that isn't accepted mustn't be left behind in the sink
+	accepted := false
+	if streamed != nil {
+		defer func() {
+			if !accepted {
+				s.discardSink(streamed.sink)
+			}
+		}()
+	}
+
+	eightBit := !isASCII(data) || (streamed != nil && streamed.eightBit)
+	if s.Reject8BitWithout8BITMIME && conn.BodyType != "8BITMIME" && !usesExtension(conn.usedExtensions, "SMTPUTF8") && eightBit {
+		conn.abortTX()
+		conn.WriteEnhanced(554, "5.6.3", "Message contains 8-bit data but 8BITMIME was not negotiated")
+		return nil
+	}
+
+	if s.StripReturnPath {
+		data = stripHeader(data, "Return-Path")
+	}
+	data = s.receivedHeader(conn) + data
+
+	opts := MessageOptions{
+		SMTPUTF8:   usesExtension(conn.usedExtensions, "SMTPUTF8"),
+		ReceivedAt: s.now(),
+		Now:        s.Now,
+		RemoteAddr: conn.RemoteAddr(),
+		HeloHost:   conn.HeloHost,
+	}
+	pipelined := conn.pipelined
+
+	// parsing & screening the content is CPU bound, so it's throttled separately to handling
+	release := s.acquireParse()
+	message, err := NewMessageWithOptions([]byte(data), conn.ToAddr, s.Logger, opts)
+	if err == nil {
+		err = conn.EndTX()
+	}
+	if err != nil {
+		release()
+	}
+	if perr, ok := err.(*ParseError); ok {
+		conn.WriteSMTP(parseErrorCode(perr), fmt.Sprintf("Error while reading SMTP message data. %v", perr))
+		return nil
+	} else if err != nil {
+		conn.WriteSMTP(554, fmt.Sprintf("Error while reading SMTP message data. %v", err))
+		return nil
+	}
+
+	if streamed != nil {
+		message.openBody = streamed.sink.body(streamed.skip)
+	}
+	message.TransferMethod = method
+	message.UsedExtensions = conn.usedExtensions
+	if pipelined {
+		message.UsedExtensions = append(message.UsedExtensions, "PIPELINING")
+	}
+	if method == "BDAT" {
+		message.UsedExtensions = append(message.UsedExtensions, "CHUNKING")
+	}
+	message.ConnInfo = conn.Info()
+	message.DSN = conn.DSN
+
+	code, reply := s.screen(message)
+	release()
+
+	for _, warning := range message.Warnings() {
+		s.logf(LogInfo, "Message %v: %v", message.ID(), warning)
+	}
+
+	if code != 0 {
+		conn.WriteSMTP(code, reply)
+	} else if err := s.handleMessage(message); err == nil {
+		accepted = true
+		conn.WriteSMTP(250, fmt.Sprintf("OK : queued as %v", message.ID()))
+	} else if result, ok := err.(HandlerResult); ok {
+		accepted = result.code() < 400
+		conn.WriteSMTP(result.code(), result.Message)
+	} else if err == ErrDropConnection {
+		conn.WriteError(ErrDropConnection)
+		return ErrDropConnection
+	} else if serr, ok := err.(SMTPError); ok {
+		conn.WriteError(serr)
+	} else if perr, ok := err.(*ParseError); ok {
+		conn.WriteSMTP(parseErrorCode(perr), fmt.Sprintf("Error while reading SMTP message data. %v", perr))
+	} else {
+		conn.WriteSMTP(554, fmt.Sprintf("Server error while processing SMTP message. %v", err))
+	}
+	return nil
+}
+
+// screen runs the content checks over a message before it's handled, returning the
+// reply to reject it with, or a zero code if it passes
+func (s *Server) screen(message *Message) (code int, reply string) {
+	// the checks pick apart untrusted content, a panic doing so mustn't take the server down
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf(LogError, "Panic screening message %v: %v", message.ID(), r)
+			code, reply = ErrLocalProcessing.Code, ErrLocalProcessing.Error()
+		}
+	}()
+
+	if s.RequireValidFrom && message.From == nil {
+		return 550, "Message has no valid From address"
+	} else if s.attachmentsTooLarge(message) {
+		return 554, "Attachments too large"
+	} else if score, spam := s.isSpam(message); spam {
+		return 550, fmt.Sprintf("Message rejected as spam (score %g)", score)
+	}
+	return 0, ""
+}
+
+// acquireParse waits for one of the MaxConcurrentParse slots, returning a function
+// to give it back. Without a limit it returns straight away
+func (s *Server) acquireParse() func() {
+	if s.MaxConcurrentParse <= 0 {
+		return func() {}
+	}
+
+	s.parseSlotsOnce.Do(func() {
+		s.parseSlots = make(chan struct{}, s.MaxConcurrentParse)
+	})
+	s.parseSlots <- struct{}{}
+	return func() { <-s.parseSlots }
+}
+
+// parseBDAT parses the arguments to BDAT, the chunk size and an optional LAST
+func parseBDAT(args string) (int64, bool, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 || (len(fields) == 2 && strings.ToUpper(fields[1]) != "LAST") {
+		return 0, false, errors.New("Syntax: BDAT <size> [LAST]")
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, errors.New("Invalid chunk size")
+	}
+	return size, len(fields) == 2, nil
+}
+
+// parseErrorCode is the reply code for a message that couldn't be parsed, transient
+// failures get a 451 so the client retries rather than bouncing the message
+func parseErrorCode(err *ParseError) int {
+	if err.Temporary() {
+		return 451
+	}
+	return 554
+}
+
+// passwordMechanisms are the AUTH mechanisms that send (something derived from) a password
+var passwordMechanisms = map[string]bool{
+	"PLAIN":    true,
+	"LOGIN":    true,
+	"CRAM-MD5": true,
+}
+
+// tlsTooWeakForAuth reports whether the AUTH args ask for a password based mechanism
+// over a TLS connection older than MinAuthTLSVersion
+func (s *Server) tlsTooWeakForAuth(conn *Conn, args string) bool {
+	state, ok := conn.ConnectionState()
+	if s.MinAuthTLSVersion == 0 || !ok {
+		return false
+	}
+	mechanism := strings.ToUpper(strings.SplitN(args, " ", 2)[0])
+	return passwordMechanisms[mechanism] && state.Version < s.MinAuthTLSVersion
+}
+
+// authStatusCodes maps AUTH reply codes to their enhanced status codes
+// see: https://tools.ietf.org/html/rfc4954#section-6
+var authStatusCodes = map[int]string{
+	235: "2.7.0",
+	421: "4.7.0",
+	454: "4.7.0",
+	501: "5.7.0",
+	535: "5.7.8",
+	538: "5.7.11",
+}
+
+// writeAuthReply writes a reply to AUTH, with the enhanced status code for its outcome
+func (s *Server) writeAuthReply(conn *Conn, code int, message string) error {
+	return conn.WriteEnhanced(code, authStatusCodes[code], message)
+}
+
+// parseXForward parses the NAME=value attributes of an XFORWARD command,
+// values of [UNAVAILABLE] are left empty
+func parseXForward(args string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Fields(args) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Bad XFORWARD attribute %v", field)
+		}
+
+		name := strings.ToUpper(kv[0])
+		switch name {
+		case "NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE":
+		default:
+			return nil, fmt.Errorf("Bad XFORWARD attribute name %v", kv[0])
+		}
+
+		if kv[1] != "[UNAVAILABLE]" && kv[1] != "[TEMPUNAVAIL]" {
+			attrs[name] = kv[1]
+		} else {
+			attrs[name] = ""
+		}
+	}
+
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("XFORWARD requires at least one attribute")
+	}
+	return attrs, nil
+}
+
 var pathRegex = regexp.MustCompile(`<([^@>]+@[^@>]+)>`)
 
+// parseParams extracts the ESMTP parameters following the path in a MAIL FROM or RCPT TO
+// argument (e.g. SIZE=1024), keyed by their upper-cased keyword
+// see: https://tools.ietf.org/html/rfc5321#section-4.1.2
+func parseParams(args string) map[string]string {
+	params := make(map[string]string)
+
+	i := strings.Index(args, ">")
+	if i < 0 {
+		return params
+	}
+
+	for _, param := range strings.Fields(args[i+1:]) {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		} else {
+			params[strings.ToUpper(kv[0])] = ""
+		}
+	}
+	return params
+}
+
+// bodyType checks the BODY parameter to MAIL, if any, against what's supported
+// see: https://tools.ietf.org/html/rfc6152
+func (s *Server) bodyType(params map[string]string) (string, error) {
+	body, ok := params["BODY"]
+	if !ok {
+		return "", nil
+	}
+
+	body = strings.ToUpper(body)
+	if body != "7BIT" && (body != "8BITMIME" || s.Disabled["8BITMIME"]) {
+		return "", errors.New("BODY parameter unrecognized")
+	}
+	return body, nil
+}
+
+// usedExtensions lists the ESMTP extensions in play for a transaction started with the supplied MAIL parameters
+func usedExtensions(conn *Conn, params map[string]string) []string {
+	var used []string
+	if conn.IsTLS {
+		used = append(used, "STARTTLS")
+	}
+	if conn.User != nil && conn.AuthMechanism != "" {
+		used = append(used, "AUTH "+conn.AuthMechanism)
+	}
+	if _, ok := params["SIZE"]; ok {
+		used = append(used, "SIZE")
+	}
+	if strings.ToUpper(params["BODY"]) == "8BITMIME" {
+		used = append(used, "8BITMIME")
+	}
+	if _, ok := params["SMTPUTF8"]; ok {
+		used = append(used, "SMTPUTF8")
+	}
+	return used
+}
+
+// isASCII reports whether s is plain ASCII, as addresses have to be without SMTPUTF8
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// usesExtension reports whether extension is among the used extensions
+func usesExtension(used []string, extension string) bool {
+	for _, u := range used {
+		if u == extension {
+			return true
+		}
+	}
+	return false
+}
+
 // GetAddressArg extracts the address value from a supplied SMTP argument
 // for handling MAIL FROM:address@example.com and RCPT TO:address@example.com
 // XXX: don't like this, feels like a hack
@@ -484,6 +1978,11 @@ func (s *Server) GetAddressArg(argName string, args string) (*mail.Address, erro
 	argSplit := strings.SplitN(args, ":", 2)
 	if len(argSplit) == 2 && strings.ToUpper(argSplit[0]) == argName {
 
+		// the null reverse-path, used for bounces, see https://tools.ietf.org/html/rfc5321#section-4.5.5
+		if argName == "FROM" && strings.HasPrefix(strings.TrimSpace(argSplit[1]), "<>") {
+			return &mail.Address{}, nil
+		}
+
 		path := pathRegex.FindString(argSplit[1])
 		if path == "" {
 			return nil, fmt.Errorf("couldnt find valid FROM path in %v", argSplit[1])
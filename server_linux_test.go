@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package smtpd_test
+
+import (
+	"net"
+	"net/textproto"
+	"syscall"
+	"testing"
+
+	"github.com/mailproto/smtpd"
+)
+
+// soReusePort is SO_REUSEPORT, which package syscall doesn't define for linux
+const soReusePort = 0xf
+
+func TestSMTPServerReusePort(t *testing.T) {
+
+	reusePort := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	first := smtpd.NewServer((&MessageRecorder{}).Record)
+	first.ListenConfig = reusePort
+
+	go first.ListenAndServe("127.0.0.1:0")
+	defer first.Close()
+
+	WaitUntilAlive(first)
+
+	second := smtpd.NewServer((&MessageRecorder{}).Record)
+	second.ListenConfig = reusePort
+
+	go second.ListenAndServe(first.Address())
+
+	if alive := <-second.Ready; !alive {
+		t.Fatal("Second server should be able to bind the same port with SO_REUSEPORT")
+	}
+
+	if first.Address() != second.Address() {
+		t.Fatalf("Expected both servers on the same address, got: %v and %v", first.Address(), second.Address())
+	}
+
+	// with the first server gone, the second should keep serving
+	first.Close()
+	defer second.Close()
+
+	for i := 0; i < 5; i++ {
+		c, err := textproto.Dial("tcp", second.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial the shared port: %v", err)
+		}
+
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Errorf("Expected a greeting from the remaining server: %v", err)
+		}
+		c.Close()
+	}
+}
@@ -1,8 +1,26 @@
 package smtpd_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -92,6 +110,14 @@ Content-Type: text/html
 		t.Errorf("wrong BCC value, want: bcc@example.net, got: %v", bcc[0].Address)
 	}
 
+	if age := time.Since(recorder.Messages[0].ReceivedAt); age < 0 || age > time.Minute {
+		t.Errorf("Expected a recent ReceivedAt, got: %v", recorder.Messages[0].ReceivedAt)
+	}
+
+	if recorder.Messages[0].TransferMethod != "DATA" {
+		t.Errorf("wrong TransferMethod, want: DATA, got: %v", recorder.Messages[0].TransferMethod)
+	}
+
 }
 
 func TestSMTPServerTimeout(t *testing.T) {
@@ -146,3 +172,3886 @@ func TestSMTPServerNoTLS(t *testing.T) {
 	}
 
 }
+
+func TestSMTPServerCommandTimeouts(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	// Commands have to arrive quickly, but the DATA body can take its time
+	server.ReadTimeout = time.Millisecond * 50
+	server.CommandTimeouts = map[string]time.Duration{
+		"DATA": time.Second * 2,
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<recipient@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("Should be able to start DATA: %v", err)
+	}
+
+	// Dawdle for longer than the command timeout before sending the body
+	time.Sleep(time.Millisecond * 200)
+
+	w := c.DotWriter()
+	fmt.Fprint(w, "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body")
+	w.Close()
+
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("DATA should have been allowed the longer timeout: %v", err)
+	}
+
+	// Dawdling between commands should get us disconnected
+	time.Sleep(time.Millisecond * 200)
+
+	c.PrintfLine("NOOP")
+	if _, _, err := c.ReadResponse(250); err == nil {
+		t.Error("Should have timed out waiting for the next command")
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerCapabilities(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.TLSConfig = TestingTLSConfig()
+	server.Auth = smtpd.NewAuth()
+	server.Auth.(*smtpd.Auth).Extend("PLAIN", &smtpd.AuthPlain{})
+	server.Extend("XTEST", &smtpd.SimpleExtension{Ehlo: "param"})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	checkEHLO := func(c *textproto.Conn, want []string) {
+		c.PrintfLine("EHLO localhost")
+		_, msg, err := c.ReadResponse(250)
+		if err != nil {
+			t.Fatalf("EHLO failed: %v", err)
+		}
+
+		// the first line is the greeting, the rest are capabilities
+		got := strings.Split(msg, "\n")[1:]
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Wrong capabilities, want: %v, got: %v", want, got)
+		}
+	}
+
+	cleartext := server.Capabilities(&smtpd.Conn{})
+	if len(cleartext) != 9 || cleartext[1] != "STARTTLS" {
+		t.Errorf("Expected STARTTLS to be advertised in cleartext, got: %v", cleartext)
+	}
+	checkEHLO(c, cleartext)
+
+	c.PrintfLine("STARTTLS")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("STARTTLS failed: %v", err)
+	}
+
+	c = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+
+	secure := server.Capabilities(&smtpd.Conn{IsTLS: true})
+	for _, capability := range secure {
+		if capability == "STARTTLS" {
+			t.Errorf("Didn't expect STARTTLS to be advertised over TLS, got: %v", secure)
+		}
+	}
+	checkEHLO(c, secure)
+}
+
+func TestSMTPServerResponseRewriter(t *testing.T) {
+
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		return errors.New("rejected")
+	})
+
+	var rewritten []string
+	server.ResponseRewriter = func(code int, msg string) (int, string) {
+		rewritten = append(rewritten, msg)
+		if code == 554 {
+			return 550, msg
+		}
+		return code, msg
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Errorf("Should be able to set a sender: %v", err)
+	}
+	if err := c.Rcpt("recipient@example.net"); err != nil {
+		t.Errorf("Should be able to set a RCPT: %v", err)
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatalf("Error creating the data body: %v", err)
+	}
+	fmt.Fprint(wc, "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body")
+
+	err = wc.Close()
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 {
+		t.Errorf("Expected the rejection to be rewritten to a 550, got: %v", err)
+	}
+
+	// EHLO lines should pass through the rewriter too
+	var sawSize bool
+	for _, msg := range rewritten {
+		if strings.HasPrefix(msg, "SIZE ") {
+			sawSize = true
+		}
+	}
+	if !sawSize {
+		t.Errorf("Expected EHLO capabilities to be rewritten, saw: %v", rewritten)
+	}
+}
+
+func TestSMTPServerTLSHandshakeFailure(t *testing.T) {
+
+	var logged bytes.Buffer
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServerWithLogger(recorder.Record, log.New(&logged, "", 0))
+	server.TLSConfig = TestingTLSConfig()
+
+	closed := make(chan bool, 1)
+	server.OnClose = func(*smtpd.Conn) {
+		closed <- true
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("STARTTLS")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("STARTTLS failed: %v", err)
+	}
+
+	// Send garbage instead of a ClientHello
+	c.PrintfLine("this is not a TLS handshake")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Expected the server to close the connection, got: %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected OnClose to fire")
+	}
+
+	if !strings.Contains(logged.String(), "Could not TLS handshake with 127.0.0.1") {
+		t.Errorf("Expected the handshake failure to be logged with the client IP, got: %v", logged.String())
+	}
+}
+
+func TestSMTPServerAddresslessFrom(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "From: Mailer;\nTo: recipient@example.net\n\nThis is the email body"
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Message without a From address should be accepted by default: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	if recorder.Messages[0].From != nil {
+		t.Errorf("Expected a nil From address, got: %v", recorder.Messages[0].From)
+	}
+
+	server.RequireValidFrom = true
+
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 {
+		t.Errorf("Expected a 550 rejection when a valid From is required, got: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected the rejected message not to be handled, got: %v messages", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerExtensionRequiresAuthentication(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	// stand-in for an auth mechanism, so the gated extension is reachable beforehand
+	server.Extend("XLOGIN", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			c.User = &TestUser{username: args}
+			return c.WriteSMTP(235, "Authentication succeeded")
+		},
+	})
+	server.Extend("XSECRET", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			if !c.Authenticated() {
+				return c.WriteSMTP(530, "Authentication required")
+			}
+			return c.WriteOK()
+		},
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("XSECRET")
+	if _, _, err := c.ReadResponse(530); err != nil {
+		t.Errorf("Extension should refuse to run before authentication: %v", err)
+	}
+
+	c.PrintfLine("XLOGIN user@example.com")
+	if _, _, err := c.ReadResponse(235); err != nil {
+		t.Fatalf("Should be able to authenticate: %v", err)
+	}
+
+	c.PrintfLine("XSECRET")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Extension should run once authenticated: %v", err)
+	}
+}
+
+func TestSMTPServerGoodbyeMessage(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.GoodbyeMessage = "Thanks for flying smtpd"
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("QUIT")
+	if _, msg, err := c.ReadResponse(221); err != nil {
+		t.Errorf("Server wouldn't accept QUIT: %v", err)
+	} else if msg != server.GoodbyeMessage {
+		t.Errorf("Wrong goodbye message, want: %v, got: %v", server.GoodbyeMessage, msg)
+	}
+}
+
+func TestSMTPServerDotStuffedAttachments(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	// Both attachments contain lines that have to be dot-stuffed on the wire. Base64
+	// never produces a leading dot, so the binary one is quoted-printable
+	encoded := ".=00=FF\n..\n.leading dot=\n\n.=0D=0A."
+	binary, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := ".\n..\n.leading dot"
+
+	body := fmt.Sprintf(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="dots"
+
+--dots
+Content-Type: application/octet-stream; name="dots.bin"
+Content-Transfer-Encoding: quoted-printable
+Content-Disposition: attachment; filename="dots.bin"
+
+%v
+--dots
+Content-Type: text/plain; name="dots.txt"
+Content-Disposition: attachment; filename="dots.txt"
+
+%v
+--dots--
+`, encoded, text)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Should be able to send the message: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	attachments, err := recorder.Messages[0].Attachments()
+	if err != nil {
+		t.Fatalf("couldn't load attachments: %v", err)
+	}
+
+	if len(attachments) != 2 {
+		t.Fatalf("want two attachments, got: %v", len(attachments))
+	}
+
+	if !bytes.Equal(attachments[0].Body, binary) {
+		t.Errorf("Wrong binary attachment, want: %q, got: %q", binary, attachments[0].Body)
+	}
+
+	if string(attachments[1].Body) != text {
+		t.Errorf("Wrong text attachment, want: %q, got: %q", text, attachments[1].Body)
+	}
+}
+
+func TestSMTPServerMultilineHelp(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	help := []string{
+		"This is smtpd",
+		"Send mail with MAIL, RCPT and DATA",
+		"See https://github.com/mailproto/smtpd for more",
+	}
+	if err := server.SetHelp(strings.Join(help, "\n")); err != nil {
+		t.Fatalf("Should be able to set a multiline help message: %v", err)
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("HELP")
+	for i, line := range help {
+		sep := "-"
+		if i == len(help)-1 {
+			sep = " "
+		}
+		want := "214" + sep + line
+		if got, err := c.ReadLine(); err != nil {
+			t.Fatalf("Couldn't read HELP reply: %v", err)
+		} else if got != want {
+			t.Errorf("Wrong HELP line, want: %v, got: %v", want, got)
+		}
+	}
+}
+
+func TestSMTPServerGreetingTimeout(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ReadTimeout = time.Second * 5
+	server.GreetingTimeout = time.Millisecond * 50
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	// Stay silent and wait to be hung up on
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(server.ReadTimeout))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the server to drop the connection, got: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected to be dropped after the greeting timeout, took: %v", elapsed)
+	}
+}
+
+func TestSMTPServerMaxHeloLength(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	long := strings.Repeat("a", smtpd.DefaultHeloLengthMax) + ".example.com"
+
+	for _, verb := range []string{"HELO", "EHLO"} {
+		c.PrintfLine("%v %v", verb, long)
+		if _, _, err := c.ReadResponse(501); err != nil {
+			t.Errorf("Expected an over-length %v to be rejected: %v", verb, err)
+		}
+	}
+
+	c.PrintfLine("HELO client.example.com")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected a reasonable HELO to be accepted: %v", err)
+	}
+}
+
+func TestSMTPServerPeekHandler(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	var peeked []byte
+	server.PeekBytes = 64
+	server.PeekHandler = func(conn *smtpd.Conn, head []byte) error {
+		peeked = head
+		if bytes.Contains(head, []byte("Cheap watches")) {
+			return smtpd.NewError(550, "Looks like spam")
+		}
+		return nil
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	spam := "From: sender@example.org\nSubject: Cheap watches\n\n" + strings.Repeat("Buy now! ", 100)
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, spam)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 {
+		t.Errorf("Expected the peek handler to reject with a 550, got: %v", err)
+	}
+
+	if len(peeked) != server.PeekBytes {
+		t.Errorf("Expected to peek at %v bytes, got: %v", server.PeekBytes, len(peeked))
+	}
+
+	ham := "From: sender@example.org\nSubject: Hello\n\nThis is the email body"
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, ham); err != nil {
+		t.Errorf("Expected a short, clean message to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	if string(recorder.Messages[0].RawBody) != "This is the email body" {
+		t.Errorf("Wrong body, got: %v", string(recorder.Messages[0].RawBody))
+	}
+}
+
+func TestSMTPServerOverloadMessage(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxConn = 1
+	server.OverloadMessage = "mx1 overloaded, try mx2"
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	// Hold the only available connection open
+	first, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer first.Close()
+
+	if _, _, err := first.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	second, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer second.Close()
+
+	if _, msg, err := second.ReadResponse(554); err != nil {
+		t.Errorf("Expected the second connection to be turned away: %v", err)
+	} else if msg != server.OverloadMessage {
+		t.Errorf("Wrong overload message, want: %v, got: %v", server.OverloadMessage, msg)
+	}
+}
+
+func TestSMTPServerMaxConn(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxConn = 1
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	first, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+
+	if _, _, err := first.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	second, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+
+	if _, msg, err := second.ReadResponse(554); err != nil {
+		t.Errorf("Expected the second connection to be turned away: %v", err)
+	} else if msg != smtpd.DefaultOverloadMessage {
+		t.Errorf("Wrong overload message, want: %v, got: %v", smtpd.DefaultOverloadMessage, msg)
+	}
+	second.Close()
+
+	// once the first session ends its slot is free again
+	first.PrintfLine("QUIT")
+	first.ReadResponse(221)
+	first.Close()
+
+	for i := 0; ; i++ {
+		third, err := textproto.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+		code, _, _ := third.ReadResponse(0)
+		third.Close()
+		if code == 220 {
+			break
+		} else if i == 10 {
+			t.Fatalf("Expected a connection to be accepted once the first closed, got: %v", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSMTPServerRequireTLS(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.TLSConfig = TestingTLSConfig()
+	server.RequireTLS = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if lines := strings.Split(msg, "\n"); len(lines) < 2 || lines[1] != "STARTTLS" {
+		t.Errorf("Expected STARTTLS to be the first capability advertised, got: %v", lines)
+	}
+
+	for _, cmd := range []string{"MAIL FROM:<sender@example.org>", "RCPT TO:<recipient@example.net>", "DATA"} {
+		c.PrintfLine("%v", cmd)
+		if _, msg, err := c.ReadResponse(530); err != nil {
+			t.Errorf("Expected %v to be refused before STARTTLS: %v", cmd, err)
+		} else if msg != "Must issue a STARTTLS command first" {
+			t.Errorf("Wrong refusal for %v, got: %v", cmd, msg)
+		}
+	}
+}
+
+func TestSMTPServerConnValues(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	// a two step negotiation: XSTEP1 stashes a value which XSTEP2 picks up
+	server.Extend("XSTEP1", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			c.Set("step1", args)
+			return c.WriteOK()
+		},
+	})
+	server.Extend("XSTEP2", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			if v, ok := c.Get("step1").(string); ok {
+				return c.WriteSMTP(250, v)
+			}
+			return c.WriteSMTP(503, "Bad sequence of commands")
+		},
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("XSTEP1 remember-me")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("XSTEP1 failed: %v", err)
+	}
+
+	c.PrintfLine("XSTEP2")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Errorf("XSTEP2 failed: %v", err)
+	} else if msg != "remember-me" {
+		t.Errorf("Wrong value carried between commands, want: remember-me, got: %v", msg)
+	}
+
+	// and a reset should clear it
+	c.PrintfLine("RSET")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("RSET failed: %v", err)
+	}
+
+	c.PrintfLine("XSTEP2")
+	if _, _, err := c.ReadResponse(503); err != nil {
+		t.Errorf("Expected values to be cleared by RSET: %v", err)
+	}
+}
+
+func TestSMTPServerMultipleHandlers(t *testing.T) {
+
+	archive := &MessageRecorder{}
+	process := &MessageRecorder{}
+	forward := &MessageRecorder{}
+
+	server := smtpd.NewServer(archive.Record)
+	server.AddHandler(process.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body"
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Should be able to send a message: %v", err)
+	}
+
+	if len(archive.Messages) != 1 || len(process.Messages) != 1 {
+		t.Fatalf("Expected both handlers to get the message, got: %v and %v", len(archive.Messages), len(process.Messages))
+	}
+
+	server.AddHandler(func(msg *smtpd.Message) error {
+		return smtpd.NewError(550, "Rejected by policy")
+	})
+	server.AddHandler(forward.Record)
+
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 {
+		t.Errorf("Expected the rejecting handler's 550, got: %v", err)
+	}
+
+	if len(archive.Messages) != 2 || len(process.Messages) != 2 {
+		t.Errorf("Expected handlers before the rejection to run, got: %v and %v", len(archive.Messages), len(process.Messages))
+	}
+
+	if len(forward.Messages) != 0 {
+		t.Errorf("Expected handlers after the rejection not to run, got: %v", len(forward.Messages))
+	}
+}
+
+func TestSMTPServerMessageRate(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	// sendMessages sends up to n messages on a single connection, returning how many made it
+	sendMessages := func(n int) (int, error) {
+		c, err := smtp.Dial(server.Address())
+		if err != nil {
+			return 0, err
+		}
+		defer c.Close()
+
+		for i := 0; i < n; i++ {
+			if err := c.Mail("sender@example.org"); err != nil {
+				return i, err
+			}
+			if err := c.Rcpt("recipient@example.net"); err != nil {
+				return i, err
+			}
+			wc, err := c.Data()
+			if err != nil {
+				return i, err
+			}
+			fmt.Fprint(wc, "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body")
+			if err := wc.Close(); err != nil {
+				return i, err
+			}
+		}
+		return n, nil
+	}
+
+	server.MaxMessagesPerConn = 2
+
+	sent, err := sendMessages(3)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 452 || sent != 2 {
+		t.Errorf("Expected a 452 after 2 messages, got: %v after %v", err, sent)
+	}
+
+	server.MaxMessagesPerConn = 0
+	server.MessageInterval = time.Second
+
+	sent, err = sendMessages(2)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 452 || sent != 1 {
+		t.Errorf("Expected a 452 for sending faster than the interval, got: %v after %v", err, sent)
+	}
+}
+
+func TestSMTPServerMessageLimitSurvivesSTARTTLS(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.TLSConfig = TestingTLSConfig()
+	server.MaxMessagesPerConn = 1
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	send := func() error {
+		if err := c.Mail("sender@example.org"); err != nil {
+			return err
+		}
+		if err := c.Rcpt("recipient@example.net"); err != nil {
+			return err
+		}
+		wc, err := c.Data()
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(wc, "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body")
+		return wc.Close()
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("Expected the first message to be accepted: %v", err)
+	}
+
+	// STARTTLS resets the SMTP session, but not what the connection has already sent
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Should be able to negotiate some TLS? %v", err)
+	}
+
+	err = send()
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 452 {
+		t.Errorf("Expected a 452 after STARTTLS, got: %v", err)
+	}
+}
+
+func TestSMTPServerXForward(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	trusted := true
+	server.TrustXForward = func(*smtpd.Conn) bool {
+		return trusted
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO relay.example.com")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if !strings.Contains(msg, "XFORWARD") {
+		t.Errorf("Expected XFORWARD to be advertised to a trusted relay, got: %v", msg)
+	}
+
+	c.PrintfLine("XFORWARD NAME=client.example.org ADDR=192.0.2.7 PROTO=ESMTP HELO=client-helo.example.org")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("XFORWARD failed: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<recipient@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("Should be able to start DATA: %v", err)
+	}
+
+	w := c.DotWriter()
+	fmt.Fprint(w, "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body")
+	w.Close()
+
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Message should have been accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	hops := recorder.Messages[0].ReceivedHops()
+	if len(hops) != 1 {
+		t.Fatalf("Expected a Received header to be added, got: %v", len(hops))
+	}
+
+	if want := "from client-helo.example.org (client.example.org [192.0.2.7])"; !strings.HasPrefix(hops[0].Raw, want) {
+		t.Errorf("Expected the Received header to reflect the original client, want: %v, got: %v", want, hops[0].Raw)
+	}
+
+	if hops[0].With != "ESMTP" || hops[0].By != server.ServerName {
+		t.Errorf("Wrong Received header, got: %+v", hops[0])
+	}
+
+	trusted = false
+
+	c.PrintfLine("XFORWARD ADDR=192.0.2.8")
+	if _, _, err := c.ReadResponse(550); err != nil {
+		t.Errorf("Expected XFORWARD from an untrusted peer to be refused: %v", err)
+	}
+}
+
+func TestSMTPServerLongEHLOCapability(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Extend("XLONG", &smtpd.SimpleExtension{Ehlo: strings.Repeat("PARAM ", 200)})
+	server.Extend("XSHORT", &smtpd.SimpleExtension{Ehlo: "PARAM"})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+
+	for _, line := range strings.Split(msg, "\n") {
+		if len(line) > smtpd.MaxReplyLineLength {
+			t.Errorf("Got an over-long EHLO line: %v bytes", len(line))
+		}
+		if strings.HasPrefix(line, "XLONG") {
+			t.Error("Expected the over-long capability to be left out")
+		}
+	}
+
+	if !strings.Contains(msg, "XSHORT PARAM") {
+		t.Errorf("Expected the other capabilities to still be advertised, got: %v", msg)
+	}
+
+	// and the session should carry on as normal
+	c.PrintfLine("NOOP")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Session should continue after EHLO: %v", err)
+	}
+}
+
+func TestSMTPServerDropConnection(t *testing.T) {
+
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		return smtpd.ErrDropConnection
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("sender@example.org"); err != nil {
+		t.Errorf("Should be able to set a sender: %v", err)
+	}
+	if err := c.Rcpt("recipient@example.net"); err != nil {
+		t.Errorf("Should be able to set a RCPT: %v", err)
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatalf("Error creating the data body: %v", err)
+	}
+	fmt.Fprint(wc, "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body")
+
+	err = wc.Close()
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != smtpd.ErrDropConnection.Code {
+		t.Errorf("Expected the drop reply, got: %v", err)
+	}
+
+	if err := c.Noop(); err == nil {
+		t.Error("Expected the connection to be closed after the drop reply")
+	}
+}
+
+func TestSMTPServerMaxAttachmentBytes(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxSize = 1 << 20
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	attachment := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 600))
+	body := fmt.Sprintf(`From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="parts"
+
+--parts
+Content-Type: text/plain
+
+See attached
+--parts
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="one.bin"
+
+%v
+--parts
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="two.bin"
+
+%v
+--parts--
+`, attachment, attachment)
+
+	server.MaxAttachmentBytes = 1000
+
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 554 {
+		t.Errorf("Expected attachments over the limit to be rejected with a 554, got: %v", err)
+	}
+
+	server.MaxAttachmentBytes = 2000
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Errorf("Expected attachments under the limit to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerALPN(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	if err := server.SetALPN("smtp"); err == nil {
+		t.Error("Expected an error configuring ALPN without TLS")
+	}
+
+	certFile, keyFile := WriteTestingKeypair(t)
+	if err := server.UseTLS(certFile, keyFile); err != nil {
+		t.Fatalf("Should be able to load the TLS keypair: %v", err)
+	}
+
+	if err := server.SetALPN("smtp"); err != nil {
+		t.Fatalf("Should be able to configure ALPN: %v", err)
+	}
+
+	if len(server.TLSConfig.NextProtos) != 1 || server.TLSConfig.NextProtos[0] != "smtp" {
+		t.Errorf("Wrong NextProtos, want: [smtp], got: %v", server.TLSConfig.NextProtos)
+	}
+
+	if err := server.SetALPN(); err != nil {
+		t.Fatalf("Should be able to clear ALPN: %v", err)
+	}
+
+	if len(server.TLSConfig.NextProtos) != 0 {
+		t.Errorf("Expected ALPN to be cleared, got: %v", server.TLSConfig.NextProtos)
+	}
+}
+
+func TestSMTPServerAbortedData(t *testing.T) {
+
+	var logged bytes.Buffer
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServerWithLogger(recorder.Record, log.New(&logged, "", 0))
+
+	closed := make(chan bool, 1)
+	server.OnClose = func(*smtpd.Conn) {
+		closed <- true
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<recipient@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("Should be able to start DATA: %v", err)
+	}
+
+	// send half a message, then hang up without the terminating dot
+	c.PrintfLine("From: sender@example.org")
+	c.PrintfLine("To: recipient@example.net")
+	c.PrintfLine("")
+	c.PrintfLine("This is only half of the")
+	c.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to end")
+	}
+
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected the partial message not to be delivered, got: %v", len(recorder.Messages))
+	}
+
+	if !strings.Contains(logged.String(), "DATA aborted") {
+		t.Errorf("Expected the aborted DATA to be logged, got: %v", logged.String())
+	}
+}
+
+func TestSMTPServerNullSender(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected the null sender to be accepted by default: %v", err)
+	}
+
+	c.PrintfLine("RSET")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("RSET failed: %v", err)
+	}
+
+	server.AllowNullSender = false
+
+	c.PrintfLine("MAIL FROM:<>")
+	if _, msg, err := c.ReadResponse(550); err != nil {
+		t.Errorf("Expected the null sender to be rejected: %v", err)
+	} else if msg != "Null sender not allowed" {
+		t.Errorf("Wrong rejection, got: %v", msg)
+	}
+}
+
+func TestSMTPServerEchoClient(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.EchoClient = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	want := fmt.Sprintf("%v Hello client.example.net [127.0.0.1]", server.ServerName)
+
+	c.PrintfLine("HELO client.example.net")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("HELO failed: %v", err)
+	} else if msg != want {
+		t.Errorf("Wrong HELO greeting, want: %v, got: %v", want, msg)
+	}
+
+	c.PrintfLine("EHLO client.example.net")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if first := strings.Split(msg, "\n")[0]; first != want {
+		t.Errorf("Wrong EHLO greeting, want: %v, got: %v", want, first)
+	}
+}
+
+func TestSMTPServerScoreFunc(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.RejectScore = 5
+	server.ScoreFunc = func(msg *smtpd.Message) (float64, error) {
+		if strings.Contains(msg.Subject, "Cheap watches") {
+			return 12.5, nil
+		}
+		return 0.3, nil
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	spam := "From: sender@example.org\nSubject: Cheap watches\n\nBuy now!"
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, spam)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 550 || tpErr.Msg != "Message rejected as spam (score 12.5)" {
+		t.Errorf("Expected a high scoring message to be rejected, got: %v", err)
+	}
+
+	ham := "From: sender@example.org\nSubject: Hello\n\nThis is the email body"
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, ham); err != nil {
+		t.Errorf("Expected a low scoring message to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerSMTPUTF8Headers(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.SMTPUTF8 = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO client.example.net")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+	c.PrintfLine("MAIL FROM:<sender@example.org> SMTPUTF8")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<recipient@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("Should be able to start DATA: %v", err)
+	}
+
+	subject := "Grüße aus 東京 =?not-an-encoded-word?="
+	c.PrintfLine("From: Jörg <sender@example.org>")
+	c.PrintfLine("To: recipient@example.net")
+	c.PrintfLine("Subject: %v", subject)
+	c.PrintfLine("")
+	c.PrintfLine("This is the email body")
+	c.PrintfLine(".")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	msg := recorder.Messages[0]
+	if !msg.SMTPUTF8 {
+		t.Error("Expected the message to be marked as SMTPUTF8")
+	}
+	if msg.Subject != subject {
+		t.Errorf("Wrong subject, want: %v, got: %v", subject, msg.Subject)
+	}
+	if msg.From == nil || msg.From.Name != "Jörg" {
+		t.Errorf("Expected the UTF-8 display name to be preserved, got: %v", msg.From)
+	}
+}
+
+func TestSMTPServerMaxDataLines(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxDataLines = 5
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	long := "From: sender@example.org\nTo: recipient@example.net\n\n" + strings.Repeat("a\n", 10)
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, long)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 552 || tpErr.Msg != "Too many lines" {
+		t.Errorf("Expected a message with too many lines to be rejected, got: %v", err)
+	}
+
+	short := "From: sender@example.org\nTo: recipient@example.net\n\nline one\nline two"
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, short); err != nil {
+		t.Errorf("Expected a short multi-line message to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	if body := string(recorder.Messages[0].RawBody); body != "line one\nline two" {
+		t.Errorf("Wrong body, got: %q", body)
+	}
+}
+
+func TestSMTPServerParseErrors(t *testing.T) {
+
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		// e.g. a charset decoder that's only temporarily unavailable
+		return &smtpd.ParseError{Err: errors.New("Charset decoder unavailable"), Transient: true}
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body"
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 451 {
+		t.Errorf("Expected a transient parse failure to be a 451, got: %v", err)
+	}
+
+	malformed := "From sender@example.org\n\nThis has no headers to speak of"
+	err = SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, malformed)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 554 {
+		t.Errorf("Expected a malformed message to be a 554, got: %v", err)
+	}
+}
+
+func TestSMTPServerMaxSize(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxSize = 1024
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	send := func(body string) error {
+		if err := c.Mail("sender@example.org"); err != nil {
+			return err
+		}
+		if err := c.Rcpt("recipient@example.net"); err != nil {
+			return err
+		}
+		wc, err := c.Data()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(wc, "From: sender@example.org\nTo: recipient@example.net\n\n%v", body)
+		return wc.Close()
+	}
+
+	err = send(strings.Repeat("too big\n", 512))
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 552 || tpErr.Msg != "Message too big" {
+		t.Errorf("Expected a message over MaxSize to be refused, got: %v", err)
+	}
+
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected the handler not to be called, got: %v messages", len(recorder.Messages))
+	}
+
+	// the limit is per message, and the session carries on after a refusal
+	for i := 0; i < 3; i++ {
+		if err := send(strings.Repeat("small\n", 100)); err != nil {
+			t.Errorf("Expected a message under MaxSize to be accepted: %v", err)
+		}
+	}
+
+	if len(recorder.Messages) != 3 {
+		t.Errorf("Expected 3 messages, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerRejectPreGreet(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.GreetDelay = 200 * time.Millisecond
+	server.RejectPreGreet = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	// a client that doesn't wait for the banner
+	early, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer early.Close()
+
+	early.PrintfLine("EHLO client.example.net")
+	if _, _, err := early.ReadResponse(220); err == nil {
+		t.Error("Expected a client talking before the greeting to be rejected")
+	} else if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 554 {
+		t.Errorf("Expected a 554, got: %v", err)
+	}
+
+	// and one that does
+	patient, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer patient.Close()
+
+	if _, _, err := patient.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+	patient.PrintfLine("EHLO client.example.net")
+	if _, _, err := patient.ReadResponse(250); err != nil {
+		t.Errorf("Expected a client that waited to be accepted: %v", err)
+	}
+}
+
+func TestSMTPServerRecipientErrors(t *testing.T) {
+
+	var logged bytes.Buffer
+	server := smtpd.NewServerWithLogger(func(msg *smtpd.Message) error {
+		return smtpd.RecipientErrors{
+			"full@example.net": smtpd.NewError(452, "Mailbox full"),
+		}
+	}, log.New(&logged, "", 0))
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "From: sender@example.org\nTo: ok@example.net, full@example.net\n\nThis is the email body"
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"ok@example.net", "full@example.net"}, body); err != nil {
+		t.Errorf("Expected a partial success to be accepted: %v", err)
+	}
+
+	if !strings.Contains(logged.String(), "not delivered to full@example.net: Mailbox full") {
+		t.Errorf("Expected the failed recipient to be logged, got: %v", logged.String())
+	}
+
+	err := SendMessage(server.Address(), "sender@example.org", []string{"full@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 452 {
+		t.Errorf("Expected the recipient's error when none succeeded, got: %v", err)
+	}
+}
+
+func TestSMTPServerPipelining(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if !strings.Contains(msg, "\nPIPELINING") {
+		t.Errorf("Expected PIPELINING to be advertised, got: %v", msg)
+	}
+
+	// the whole group goes out in a single write
+	fmt.Fprint(conn, "MAIL FROM:<sender@example.org>\r\nRCPT TO:<one@example.net>\r\nRCPT TO:<bogus>\r\nDATA\r\n")
+
+	for _, code := range []int{250, 250, 501, 354} {
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("Expected a %v reply: %v", code, err)
+		}
+	}
+
+	w := c.DotWriter()
+	fmt.Fprint(w, "From: sender@example.org\nTo: one@example.net\n\nThis is the email body")
+	w.Close()
+
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Message should have been accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	if used := recorder.Messages[0].UsedExtensions; len(used) == 0 || used[len(used)-1] != "PIPELINING" {
+		t.Errorf("Expected PIPELINING among the used extensions, got: %v", used)
+	}
+}
+
+func TestSMTPServerMaxIdle(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	logger := &LineLogger{}
+	server := smtpd.NewServerWithLogger(recorder.Record, logger)
+	server.ReadTimeout = time.Minute
+	server.MaxIdle = 200 * time.Millisecond
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	// go quiet, well inside the ReadTimeout
+	closed := make(chan error, 1)
+	go func() {
+		_, err := c.ReadLine()
+		closed <- err
+	}()
+
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("Expected the idle connection to be closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the reaper to close the idle connection")
+	}
+
+	if lines := logger.Lines(); !strings.Contains(strings.Join(lines, ""), "idle") {
+		t.Errorf("Expected the reaping to be logged, got: %v", lines)
+	}
+}
+
+func TestSMTPServer8BitMIME(t *testing.T) {
+
+	var bodyTypes []string
+	server := smtpd.NewServer(func(msg *smtpd.Message) error { return nil })
+	server.Extend("XBODY", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			bodyTypes = append(bodyTypes, c.BodyType)
+			return c.WriteOK()
+		},
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if !strings.Contains(msg, "\n8BITMIME") {
+		t.Errorf("Expected 8BITMIME to be advertised, got: %v", msg)
+	}
+
+	for _, body := range []string{"7BIT", "8BITMIME"} {
+		c.PrintfLine("MAIL FROM:<sender@example.org> BODY=%v", body)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Errorf("Expected BODY=%v to be accepted: %v", body, err)
+		}
+		c.PrintfLine("XBODY")
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("XBODY failed: %v", err)
+		}
+		c.PrintfLine("RSET")
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("RSET failed: %v", err)
+		}
+	}
+
+	if strings.Join(bodyTypes, ",") != "7BIT,8BITMIME" {
+		t.Errorf("Wrong body types, want: 7BIT,8BITMIME, got: %v", bodyTypes)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org> BODY=BINARYMIME")
+	if _, msg, err := c.ReadResponse(501); err != nil {
+		t.Errorf("Expected an unknown BODY to be refused: %v", err)
+	} else if msg != "BODY parameter unrecognized" {
+		t.Errorf("Wrong refusal, got: %v", msg)
+	}
+
+	server.Disable("8BITMIME")
+
+	c.PrintfLine("MAIL FROM:<sender@example.org> BODY=8BITMIME")
+	if _, _, err := c.ReadResponse(501); err != nil {
+		t.Errorf("Expected BODY=8BITMIME to be refused once disabled: %v", err)
+	}
+}
+
+func TestSMTPServerDisabledCapabilities(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Disable("BDAT", "DSN", "PIPELINING", "8BITMIME")
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	_, msg, err := c.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+
+	for _, keyword := range []string{"CHUNKING", "DSN", "PIPELINING", "8BITMIME"} {
+		for _, line := range strings.Split(msg, "\n") {
+			if line == keyword {
+				t.Errorf("Expected %v not to be advertised once disabled, got: %v", keyword, msg)
+			}
+		}
+	}
+	if !strings.Contains(msg, "SIZE") {
+		t.Errorf("Expected the rest to still be advertised, got: %v", msg)
+	}
+}
+
+func TestSMTPServerStripReturnPath(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "Return-Path: <bounces@upstream.example.com>\nFrom: sender@example.org\nTo: recipient@example.net\n\nReturn-Path: is just text down here"
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+
+	if rp := recorder.Messages[0].ReturnPath(); rp == nil || rp.Address != "bounces@upstream.example.com" {
+		t.Errorf("Expected the client's Return-Path to be readable, got: %v", rp)
+	}
+
+	server.StripReturnPath = true
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+
+	msg := recorder.Messages[1]
+	if rp := msg.ReturnPath(); rp != nil {
+		t.Errorf("Expected the Return-Path to be stripped, got: %v", rp)
+	}
+	if bytes.Contains(msg.Source, []byte("upstream.example.com")) {
+		t.Errorf("Expected the Return-Path to be gone from the message source, got: %s", msg.Source)
+	}
+	if string(msg.RawBody) != "Return-Path: is just text down here" {
+		t.Errorf("Expected the body to be untouched, got: %q", msg.RawBody)
+	}
+}
+
+func TestSMTPServerSMTPUTF8Addresses(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.SMTPUTF8 = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if !strings.Contains(msg, "\nSMTPUTF8") {
+		t.Errorf("Expected SMTPUTF8 to be advertised, got: %v", msg)
+	}
+
+	c.PrintfLine("MAIL FROM:<用户@例え.jp>")
+	if _, _, err := c.ReadResponse(553); err != nil {
+		t.Errorf("Expected a UTF-8 address to be refused without SMTPUTF8: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<用户@例え.jp> SMTPUTF8")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a UTF-8 sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<größe@bücher.example>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a UTF-8 RCPT: %v", err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("Should be able to start DATA: %v", err)
+	}
+
+	c.PrintfLine("From: 用户@例え.jp")
+	c.PrintfLine("To: größe@bücher.example")
+	c.PrintfLine("")
+	c.PrintfLine("This is the email body")
+	c.PrintfLine(".")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	msg := recorder.Messages[0]
+	if msg.From == nil || msg.From.Address != "用户@例え.jp" {
+		t.Errorf("Expected the UTF-8 From address intact, got: %v", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0].Address != "größe@bücher.example" {
+		t.Errorf("Expected the UTF-8 To address intact, got: %v", msg.To)
+	}
+
+	server.SMTPUTF8 = false
+
+	c.PrintfLine("MAIL FROM:<用户@例え.jp> SMTPUTF8")
+	if _, _, err := c.ReadResponse(555); err != nil {
+		t.Errorf("Expected SMTPUTF8 to be refused once disabled: %v", err)
+	}
+}
+
+func TestSMTPServerChunking(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if !strings.Contains(msg, "\nCHUNKING") {
+		t.Errorf("Expected CHUNKING to be advertised, got: %v", msg)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<recipient@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+
+	// the chunks aren't dot-stuffed or line based, so a lone "." is just data
+	first := "From: sender@example.org\r\nTo: recipient@example.net\r\n\r\nfirst chunk\r\n.\r\n"
+	second := "second chunk \x00\xff\r\n"
+
+	fmt.Fprintf(conn, "BDAT %v\r\n%v", len(first), first)
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the first chunk to be accepted: %v", err)
+	} else if msg != fmt.Sprintf("%v octets received", len(first)) {
+		t.Errorf("Wrong reply to the first chunk, got: %v", msg)
+	}
+
+	fmt.Fprintf(conn, "BDAT %v LAST\r\n%v", len(second), second)
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the last chunk to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	msg := recorder.Messages[0]
+	if want := "first chunk\r\n.\r\nsecond chunk \x00\xff\r\n"; string(msg.RawBody) != want {
+		t.Errorf("Wrong reassembled body, want: %q, got: %q", want, msg.RawBody)
+	}
+	if msg.TransferMethod != "BDAT" {
+		t.Errorf("Wrong transfer method, got: %v", msg.TransferMethod)
+	}
+}
+
+func TestSMTPServerMessages(t *testing.T) {
+
+	server := smtpd.NewServer(nil)
+	server.MessageBuffer = 1
+	server.MessageTimeout = 100 * time.Millisecond
+	messages := server.Messages()
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	for _, subject := range []string{"first", "second"} {
+		body := fmt.Sprintf("From: sender@example.org\nTo: recipient@example.net\nSubject: %v\n\nThis is the email body", subject)
+		if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+			t.Fatalf("Expected the message to be accepted: %v", err)
+		}
+
+		select {
+		case msg := <-messages:
+			if msg.Subject != subject {
+				t.Errorf("Wrong message, want: %v, got: %v", subject, msg.Subject)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the %v message on the channel", subject)
+		}
+	}
+
+	// nobody's draining the channel now, so once it's full messages get turned away
+	body := "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body"
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Expected the message to fit in the buffer: %v", err)
+	}
+
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 451 {
+		t.Errorf("Expected a 451 with the channel full, got: %v", err)
+	}
+}
+
+func TestSMTPServerMessagesRange(t *testing.T) {
+
+	server := smtpd.NewServer(nil)
+
+	go server.ListenAndServe("localhost:0")
+	WaitUntilAlive(server)
+
+	// the channel's only asked for once the server is already serving
+	received := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		for msg := range server.Messages() {
+			received <- msg.Subject
+		}
+		close(done)
+	}()
+
+	body := "From: sender@example.org\nTo: recipient@example.net\nSubject: ranged\n\nThis is the email body"
+	go SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+
+	select {
+	case subject := <-received:
+		if subject != "ranged" {
+			t.Errorf("Wrong message, got: %v", subject)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the message on the channel")
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected a clean shutdown: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the channel to be closed once the server stopped")
+	}
+}
+
+func TestSMTPServerNoHandler(t *testing.T) {
+
+	server := smtpd.NewServer(nil)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "From: sender@example.org\nTo: recipient@example.net\n\nThis is the email body"
+	err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body)
+	if tpErr, ok := err.(*textproto.Error); !ok || tpErr.Code != 554 || tpErr.Msg != "No message handler configured" {
+		t.Errorf("Expected a 554 without a handler, got: %v", err)
+	}
+
+	// and the server's still up afterwards
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Noop(); err != nil {
+		t.Errorf("Expected the server to still be serving: %v", err)
+	}
+}
+
+func TestSMTPServerDSN(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	} else if !strings.Contains(msg, "\nDSN") {
+		t.Errorf("Expected DSN to be advertised, got: %v", msg)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org> RET=BODY")
+	if _, _, err := c.ReadResponse(501); err != nil {
+		t.Errorf("Expected an invalid RET to be refused: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org> RET=HDRS ENVID=QQ314159+2Bx")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a sender: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<one@example.net> NOTIFY=SUCCESS,NEVER")
+	if _, _, err := c.ReadResponse(501); err != nil {
+		t.Errorf("Expected NEVER alongside SUCCESS to be refused: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<one@example.net> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;one+2Balias@example.net")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+	c.PrintfLine("RCPT TO:<two@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Should be able to set a RCPT: %v", err)
+	}
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("Should be able to start DATA: %v", err)
+	}
+
+	w := c.DotWriter()
+	fmt.Fprint(w, "From: sender@example.org\nTo: one@example.net, two@example.net\n\nThis is the email body")
+	w.Close()
+
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Message should have been accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+
+	dsn := recorder.Messages[0].DSN
+	if dsn.Ret != "HDRS" || dsn.EnvID != "QQ314159+x" {
+		t.Errorf("Wrong MAIL parameters, got RET: %v, ENVID: %v", dsn.Ret, dsn.EnvID)
+	}
+	if len(dsn.Recipients) != 2 {
+		t.Fatalf("Expected DSN parameters for 2 recipients, got: %v", len(dsn.Recipients))
+	}
+
+	one := dsn.Recipients[0]
+	if one.Address.Address != "one@example.net" || !one.Wants("SUCCESS") || !one.Wants("FAILURE") || one.Wants("DELAY") {
+		t.Errorf("Wrong NOTIFY for %v, got: %v", one.Address, one.Notify)
+	}
+	if one.ORcpt != "rfc822;one+alias@example.net" {
+		t.Errorf("Wrong ORCPT, got: %v", one.ORcpt)
+	}
+	if two := dsn.Recipients[1]; two.Address.Address != "two@example.net" || len(two.Notify) != 0 {
+		t.Errorf("Expected no NOTIFY for %v, got: %v", two.Address, two.Notify)
+	}
+}
+
+func TestSMTPServerEnhancedStatusCodes(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.EnhancedStatusCodes = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	session := func(hello string) []string {
+		c, err := textproto.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+		defer c.Close()
+
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected a greeting: %v", err)
+		}
+
+		c.PrintfLine("%v localhost", hello)
+		if _, msg, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%v failed: %v", hello, err)
+		} else if hello == "EHLO" && !strings.Contains(msg, "\nENHANCEDSTATUSCODES") {
+			t.Errorf("Expected ENHANCEDSTATUSCODES to be advertised, got: %v", msg)
+		}
+
+		var replies []string
+		for _, cmd := range []string{"MAIL FROM:<sender@example.org>", "RCPT TO:<recipient@example.net>", "NOOP", "BOGUS"} {
+			c.PrintfLine("%v", cmd)
+			_, msg, _ := c.ReadResponse(0)
+			replies = append(replies, msg)
+		}
+		return replies
+	}
+
+	want := []string{"2.1.0 Accepted", "2.1.5 Accepted", "2.0.0 OK", "5.0.0 Syntax error, command unrecognised"}
+	if got := session("EHLO"); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Wrong replies after EHLO, want: %q, got: %q", want, got)
+	}
+
+	want = []string{"Accepted", "Accepted", "OK", "Syntax error, command unrecognised"}
+	if got := session("HELO"); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Wrong replies after HELO, want: %q, got: %q", want, got)
+	}
+}
+
+func TestSMTPServerVerifyPostmaster(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("VRFY postmaster")
+	if _, _, err := c.ReadResponse(252); err != nil {
+		t.Errorf("Expected a non-committal 252 without a verifier: %v", err)
+	}
+
+	server.Verifier = func(conn *smtpd.Conn, address string) error {
+		if address == "known@example.net" {
+			return nil
+		}
+		return errors.New("no such user")
+	}
+
+	c.PrintfLine("VRFY Postmaster")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected postmaster to always verify with a verifier: %v", err)
+	}
+
+	c.PrintfLine("VRFY <known@example.net>")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected a known address to verify: %v", err)
+	} else if msg != "<known@example.net>" {
+		t.Errorf("Wrong verify reply, got: %v", msg)
+	}
+
+	c.PrintfLine("VRFY unknown@example.net")
+	if _, _, err := c.ReadResponse(550); err != nil {
+		t.Errorf("Expected an unknown address not to verify: %v", err)
+	}
+}
+
+// FakeResolver answers lookups from a fixed table, anything else is not found
+type FakeResolver struct {
+	Hosts   map[string][]string
+	Addrs   map[string][]string
+	MXs     map[string][]*net.MX
+	Queries []string
+}
+
+func (r *FakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Queries = append(r.Queries, host)
+	if addrs, ok := r.Hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *FakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.Queries = append(r.Queries, addr)
+	if names, ok := r.Addrs[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *FakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.Queries = append(r.Queries, name)
+	if mxs, ok := r.MXs[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *FakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestSMTPServerDNSBL(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	resolver := &FakeResolver{Hosts: map[string][]string{
+		"1.0.0.127.listed.example.org": {"127.0.0.2"},
+	}}
+	server.Resolver = resolver
+	server.DNSBL = []string{"clean.example.org", "listed.example.org"}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, msg, err := c.ReadResponse(554); err != nil {
+		t.Errorf("Expected a listed client to be turned away: %v", err)
+	} else if !strings.Contains(msg, "listed.example.org") {
+		t.Errorf("Expected the reply to name the list, got: %v", msg)
+	}
+
+	want := []string{"1.0.0.127.clean.example.org", "1.0.0.127.listed.example.org"}
+	if fmt.Sprint(resolver.Queries) != fmt.Sprint(want) {
+		t.Errorf("Wrong DNSBL queries, want: %v, got: %v", want, resolver.Queries)
+	}
+
+	server.DNSBL = []string{"clean.example.org"}
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected an unlisted client to be accepted: %v", err)
+	}
+}
+
+func TestSMTPServerReject8Bit(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Reject8BitWithout8BITMIME = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	send := func(mail string) (int, string) {
+		c.PrintfLine("%v", mail)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("MAIL failed: %v", err)
+		}
+		c.PrintfLine("RCPT TO:<recipient@example.net>")
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("RCPT failed: %v", err)
+		}
+		c.PrintfLine("DATA")
+		if _, _, err := c.ReadResponse(354); err != nil {
+			t.Fatalf("DATA failed: %v", err)
+		}
+		c.PrintfLine("Subject: caf\xc3\xa9\r\n\r\nna\xc3\xafve\r\n.")
+		code, msg, _ := c.ReadResponse(0)
+		return code, msg
+	}
+
+	if code, msg := send("MAIL FROM:<sender@example.org>"); code != 554 {
+		t.Errorf("Expected 8-bit data without 8BITMIME to be refused, got: %v %v", code, msg)
+	} else if msg != "Message contains 8-bit data but 8BITMIME was not negotiated" {
+		t.Errorf("Wrong refusal, got: %v", msg)
+	}
+
+	if code, msg := send("MAIL FROM:<sender@example.org> BODY=8BITMIME"); code != 250 {
+		t.Errorf("Expected 8-bit data with BODY=8BITMIME to be accepted, got: %v %v", code, msg)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected exactly 1 message, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerCommandHistory(t *testing.T) {
+
+	var history []string
+	server := smtpd.NewServer(func(msg *smtpd.Message) error { return nil })
+	server.Extend("XHISTORY", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			history = c.CommandHistory()
+			return c.WriteOK()
+		},
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	for _, cmd := range []string{"EHLO localhost", "NOOP", "mail FROM:<sender@example.org>", "RSET", "XHISTORY"} {
+		c.PrintfLine("%v", cmd)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%v failed: %v", cmd, err)
+		}
+	}
+
+	want := "EHLO,NOOP,MAIL,RSET,XHISTORY"
+	if got := strings.Join(history, ","); got != want {
+		t.Errorf("Wrong command history, want: %v, got: %v", want, got)
+	}
+}
+
+func TestSMTPServerShutdown(t *testing.T) {
+
+	server := smtpd.NewServer(func(msg *smtpd.Message) error { return nil })
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe("localhost:0")
+	}()
+
+	WaitUntilAlive(server)
+	addr := server.Address()
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected ListenAndServe to return cleanly, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe didn't return after Shutdown")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected new connections to be refused after Shutdown")
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the session ended: %v", err)
+	default:
+	}
+
+	c.PrintfLine("NOOP")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected the existing session to carry on: %v", err)
+	}
+
+	c.PrintfLine("QUIT")
+	if _, _, err := c.ReadResponse(221); err != nil {
+		t.Errorf("Expected the existing session to QUIT cleanly: %v", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Expected Shutdown to drain cleanly, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Shutdown didn't return once the session ended")
+	}
+}
+
+func TestSMTPServerBadCommandTarpit(t *testing.T) {
+
+	server := smtpd.NewServer(func(msg *smtpd.Message) error { return nil })
+	server.BadCommandTarpit = true
+	server.TarpitDelay = 50 * time.Millisecond
+	server.TarpitMax = 200 * time.Millisecond
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	var elapsed []time.Duration
+	for i := 0; i < 8; i++ {
+		start := time.Now()
+		c.PrintfLine("BOGUS")
+		if _, _, err := c.ReadResponse(500); err != nil {
+			t.Fatalf("Expected the tarpitted session to stay open (command %v): %v", i+1, err)
+		}
+		elapsed = append(elapsed, time.Since(start))
+	}
+
+	// the first 4 bad commands are answered straight away, then 50ms, 100ms, 200ms and capped at 200ms
+	for i, want := range []time.Duration{0, 0, 0, 0, 50, 100, 200, 200} {
+		want *= time.Millisecond
+		if elapsed[i] < want || (want == 0 && elapsed[i] > 40*time.Millisecond) {
+			t.Errorf("Reply %v took %v, expected at least %v", i+1, elapsed[i], want)
+		}
+	}
+
+	c.PrintfLine("NOOP")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected good commands to still be answered: %v", err)
+	}
+}
+
+func TestSMTPServerRateLimiter(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	var limited string
+	server.RateLimiter = func(conn *smtpd.Conn) bool {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		return host != limited
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected an unlimited client to be served: %v", err)
+	}
+
+	limited = "127.0.0.1"
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+	if _, _, err := c.ReadResponse(421); err != nil {
+		t.Errorf("Expected the limited client to be turned away: %v", err)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestSMTPServerMaxConcurrentParse(t *testing.T) {
+
+	// the sessions run concurrently, so messages are collected on a channel rather than
+	// through a MessageRecorder
+	received := make(chan *smtpd.Message, 4)
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		received <- msg
+		return nil
+	})
+	server.MaxConcurrentParse = 1
+	server.RejectScore = 5
+
+	var lock sync.Mutex
+	var parsing, most int
+	server.ScoreFunc = func(msg *smtpd.Message) (float64, error) {
+		lock.Lock()
+		parsing++
+		if parsing > most {
+			most = parsing
+		}
+		lock.Unlock()
+
+		// a deliberately slow parse
+		time.Sleep(50 * time.Millisecond)
+
+		lock.Lock()
+		parsing--
+		lock.Unlock()
+		return 0, nil
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+				t.Errorf("Expected the message to be accepted: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(received) != 4 {
+		t.Errorf("Expected every message to be recorded, got %v", len(received))
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if most != 1 {
+		t.Errorf("Expected parsing to be serialized, got %v at once", most)
+	}
+}
+
+func TestSMTPServerHandlerResult(t *testing.T) {
+
+	var handled int
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		handled++
+		return smtpd.HandlerResult{Message: "Accepted, flagged for review"}
+	})
+	server.AddHandler(func(msg *smtpd.Message) error {
+		handled++
+		return nil
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	for _, cmd := range []string{"MAIL FROM:<sender@example.org>", "RCPT TO:<recipient@example.net>"} {
+		c.PrintfLine("%v", cmd)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%v failed: %v", cmd, err)
+		}
+	}
+
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	c.PrintfLine("Subject: hi\r\n\r\nhello\r\n.")
+	if _, msg, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected the message to be accepted: %v", err)
+	} else if msg != "Accepted, flagged for review" {
+		t.Errorf("Wrong reply, got: %v", msg)
+	}
+
+	if handled != 2 {
+		t.Errorf("Expected every handler to be called, got: %v", handled)
+	}
+}
+
+func TestSMTPServerIncompleteData(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	var logged bytes.Buffer
+	server := smtpd.NewServerWithLogger(recorder.Record, log.New(&logged, "", 0))
+
+	closed := make(chan struct{})
+	server.OnClose = func(*smtpd.Conn) {
+		close(closed)
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := net.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	for _, cmd := range []string{"MAIL FROM:<sender@example.org>", "RCPT TO:<recipient@example.net>"} {
+		c.PrintfLine("%v", cmd)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%v failed: %v", cmd, err)
+		}
+	}
+
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+
+	// hang up part way through, without the terminating dot
+	c.PrintfLine("Subject: hi\r\n\r\nhello")
+	conn.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to end")
+	}
+
+	if !strings.Contains(logged.String(), smtpd.ErrIncompleteData.Error()) {
+		t.Errorf("Expected the incomplete data to be logged, got: %v", logged.String())
+	}
+	if len(recorder.Messages) != 0 {
+		t.Errorf("Expected the incomplete message not to be delivered, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerRcptHandler(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.RcptHandler = func(conn *smtpd.Conn, rcpt *mail.Address) error {
+		if rcpt.Address != "known@example.net" {
+			return smtpd.NewEnhancedError(550, "5.1.1", "No such user")
+		}
+		return nil
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@example.org>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+
+	c.PrintfLine("RCPT TO:<unknown@example.net>")
+	if _, msg, err := c.ReadResponse(550); err != nil {
+		t.Errorf("Expected the unknown recipient to be rejected: %v", err)
+	} else if msg != "No such user" {
+		t.Errorf("Wrong rejection, got: %v", msg)
+	}
+
+	c.PrintfLine("RCPT TO:<known@example.net>")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the known recipient to be accepted: %v", err)
+	}
+
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	c.PrintfLine("Subject: hi\r\n\r\nhello\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("Expected the message to be accepted: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected exactly 1 message, got: %v", len(recorder.Messages))
+	}
+	// without a To: header every envelope recipient is a BCC
+	if to := recorder.Messages[0].BCC(); len(to) != 1 || to[0].Address != "known@example.net" {
+		t.Errorf("Expected only the accepted recipient, got: %v", to)
+	}
+}
+
+func TestSMTPServerConnectionHandler(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	resolver := &FakeResolver{Addrs: map[string][]string{
+		"127.0.0.1": {"blocked.example.org."},
+	}}
+	server.Resolver = resolver
+
+	var names []string
+	server.ConnectionHandler = func(conn *smtpd.Conn) error {
+		names = append(names, conn.ReverseDNS(), conn.ReverseDNS())
+		if conn.ReverseDNS() == "blocked.example.org" {
+			return smtpd.NewEnhancedError(554, "5.7.1", "Access denied")
+		}
+		return nil
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, msg, err := c.ReadResponse(554); err != nil {
+		t.Errorf("Expected to be refused instead of greeted: %v", err)
+	} else if msg != "Access denied" {
+		t.Errorf("Wrong refusal, got: %v", msg)
+	}
+
+	if strings.Join(names, ",") != "blocked.example.org,blocked.example.org" {
+		t.Errorf("Wrong reverse DNS, got: %v", names)
+	}
+	if len(resolver.Queries) != 1 {
+		t.Errorf("Expected the reverse DNS to be looked up once, got: %v", resolver.Queries)
+	}
+}
+
+func TestSMTPServerHeloHost(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.ValidateHelo = true
+
+	var hosts []string
+	server.Extend("XHELO", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			hosts = append(hosts, c.HeloHost)
+			return c.WriteOK()
+		},
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("HELO")
+	if _, msg, err := c.ReadResponse(501); err != nil {
+		t.Errorf("Expected HELO without a hostname to be refused: %v", err)
+	} else if msg != "Syntax: HELO hostname" {
+		t.Errorf("Wrong refusal, got: %v", msg)
+	}
+
+	c.PrintfLine("EHLO not_a domain!")
+	if _, _, err := c.ReadResponse(501); err != nil {
+		t.Errorf("Expected an invalid hostname to be refused: %v", err)
+	}
+
+	for _, cmd := range []string{"HELO mail.example.com", "XHELO", "EHLO [192.0.2.1]", "XHELO", "EHLO [IPv6:2001:db8::1]", "XHELO"} {
+		c.PrintfLine("%v", cmd)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Errorf("%v failed: %v", cmd, err)
+		}
+	}
+
+	want := "mail.example.com,[192.0.2.1],[IPv6:2001:db8::1]"
+	if got := strings.Join(hosts, ","); got != want {
+		t.Errorf("Wrong HELO hosts, want: %v, got: %v", want, got)
+	}
+}
+
+func TestSMTPServerReplaceListener(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+	oldAddr := server.Address()
+
+	c, err := textproto.Dial("tcp", oldAddr)
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	for _, cmd := range []string{"MAIL FROM:<sender@example.org>", "RCPT TO:<recipient@example.net>"} {
+		c.PrintfLine("%v", cmd)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%v failed: %v", cmd, err)
+		}
+	}
+
+	if err := server.ReplaceListener("localhost:0"); err != nil {
+		t.Fatalf("Expected the listener to be replaced: %v", err)
+	}
+	if server.Address() == oldAddr {
+		t.Errorf("Expected a new address, still got: %v", oldAddr)
+	}
+
+	c.PrintfLine("DATA")
+	if _, _, err := c.ReadResponse(354); err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	c.PrintfLine("Subject: hi\r\n\r\nhello\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Errorf("Expected the in-flight transaction to complete: %v", err)
+	}
+
+	if _, err := net.Dial("tcp", oldAddr); err == nil {
+		t.Error("Expected the old address to be closed")
+	}
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected the new address to accept connections: %v", err)
+	}
+
+	if len(recorder.Messages) != 2 {
+		t.Errorf("Expected 2 messages, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerReplaceListenerTwice(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	// keep the accept loop busy while the listener is swapped out twice over
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if conn, err := net.Dial("tcp", server.Address()); err == nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	// the swaps are raced against each other, and repeated, to catch the accept loop
+	// part way through starting a session
+	replaced := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			errs := make(chan error, 2)
+			for j := 0; j < 2; j++ {
+				go func() {
+					errs <- server.ReplaceListener("localhost:0")
+				}()
+			}
+			for j := 0; j < 2; j++ {
+				if err := <-errs; err != nil {
+					replaced <- err
+					return
+				}
+			}
+		}
+		replaced <- nil
+	}()
+
+	select {
+	case err := <-replaced:
+		if err != nil {
+			t.Errorf("Expected the listener to be replaced: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected back to back replacements not to deadlock")
+	}
+	close(stop)
+	wg.Wait()
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected the latest address to accept connections: %v", err)
+	}
+}
+
+func TestSMTPServerGreylist(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.RcptHandler = smtpd.NewGreylist(time.Minute).Handle
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	attempt := func() (int, string) {
+		c.PrintfLine("MAIL FROM:<sender@example.org>")
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("MAIL failed: %v", err)
+		}
+		c.PrintfLine("RCPT TO:<recipient@example.net>")
+		code, msg, _ := c.ReadResponse(0)
+
+		c.PrintfLine("RSET")
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("RSET failed: %v", err)
+		}
+		return code, msg
+	}
+
+	if code, msg := attempt(); code != 451 || msg != "Greylisted, try again later" {
+		t.Errorf("Expected the first attempt to be greylisted, got: %v %v", code, msg)
+	}
+
+	if code, msg := attempt(); code != 250 {
+		t.Errorf("Expected the retry to be accepted, got: %v %v", code, msg)
+	}
+}
+
+func TestMemoryGreylistStoreExpiry(t *testing.T) {
+
+	store := smtpd.NewMemoryGreylistStore(20 * time.Millisecond)
+	if store.Seen("triplet") {
+		t.Error("Expected an unknown key not to have been seen")
+	}
+
+	store.Record("triplet")
+	if !store.Seen("triplet") {
+		t.Error("Expected a recorded key to have been seen")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if store.Seen("triplet") {
+		t.Error("Expected the key to have expired")
+	}
+}
+
+func TestMemoryGreylistStoreClock(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := smtpd.NewMemoryGreylistStore(time.Hour)
+	store.Now = func() time.Time { return now }
+
+	store.Record("triplet")
+
+	now = now.Add(59 * time.Minute)
+	if !store.Seen("triplet") {
+		t.Error("Expected the key to still be remembered within the TTL")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if store.Seen("triplet") {
+		t.Error("Expected the key to have expired by the store's clock")
+	}
+}
+
+// LineLogger is a Logger that keeps each line it's given
+type LineLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *LineLogger) Print(v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func (l *LineLogger) Println(v ...interface{}) {
+	l.Print(fmt.Sprintln(v...))
+}
+
+func (l *LineLogger) Printf(format string, v ...interface{}) {
+	l.Print(fmt.Sprintf(format, v...))
+}
+
+func (l *LineLogger) Lines() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestSMTPServerQuietLogger(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServerWithLogger(recorder.Record, smtpd.QuietLogger{})
+	server.Verbose = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected the message to be accepted: %v", err)
+	}
+	if len(recorder.Messages) != 1 {
+		t.Errorf("Expected exactly 1 message, got: %v", len(recorder.Messages))
+	}
+}
+
+func TestSMTPServerCustomLogger(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	logger := &LineLogger{}
+	server := smtpd.NewServerWithLogger(recorder.Record, logger)
+	server.Verbose = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected the message to be accepted: %v", err)
+	}
+
+	var logged bool
+	for _, line := range logger.Lines() {
+		if strings.HasPrefix(line, "MAIL FROM:<sender@example.org>") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("Expected the MAIL command to be logged, got: %v", logger.Lines())
+	}
+}
+
+func TestSMTPServerStrictCommands(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.StrictCommands = true
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	for _, line := range []string{"Subject: smuggled", "Content-Type: text/plain", "--boundary"} {
+		c, err := textproto.Dial("tcp", server.Address())
+		if err != nil {
+			t.Fatalf("Should be able to dial localhost: %v", err)
+		}
+
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("Expected a greeting: %v", err)
+		}
+
+		c.PrintfLine("BOGUS")
+		if _, _, err := c.ReadResponse(500); err != nil {
+			t.Errorf("Expected an unknown command to be refused as usual: %v", err)
+		}
+
+		c.PrintfLine("%v", line)
+		if _, _, err := c.ReadResponse(554); err != nil {
+			t.Errorf("Expected %q to be a protocol violation: %v", line, err)
+		}
+		if _, err := c.ReadLine(); err == nil {
+			t.Errorf("Expected the connection to be closed after %q", line)
+		}
+		c.Close()
+	}
+}
+
+func TestSMTPServerStrictCommandsBeforeAuth(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.StrictCommands = true
+
+	serverAuth := smtpd.NewAuth()
+	serverAuth.Extend("PLAIN", &smtpd.AuthPlain{
+		Auth: func(username, password string) (smtpd.AuthUser, bool) {
+			return &TestUser{}, true
+		},
+	})
+	server.Auth = serverAuth
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	// an unauthenticated client doesn't just get told to authenticate
+	c.PrintfLine("Subject: smuggled")
+	if _, _, err := c.ReadResponse(554); err != nil {
+		t.Errorf("Expected a protocol violation ahead of the auth check: %v", err)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestSMTPServerLogLevel(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	logger := &LineLogger{}
+	server := smtpd.NewServerWithLogger(recorder.Record, logger)
+	server.SetLogLevel(smtpd.LogError)
+
+	// the session is still winding down when the client's done, so the level is only
+	// changed once it's over
+	closed := make(chan struct{}, 2)
+	server.OnClose = func(*smtpd.Conn) {
+		closed <- struct{}{}
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected the message to be accepted: %v", err)
+	}
+	<-closed
+	if lines := logger.Lines(); len(lines) != 0 {
+		t.Errorf("Expected nothing to be logged at LogError, got: %v", lines)
+	}
+
+	server.SetLogLevel(smtpd.LogDebug)
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hi\n\nhello"); err != nil {
+		t.Errorf("Expected the message to be accepted: %v", err)
+	}
+
+	var logged bool
+	for _, line := range logger.Lines() {
+		if strings.HasPrefix(line, "RCPT TO:<recipient@example.net>") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("Expected commands to be logged at LogDebug, got: %v", logger.Lines())
+	}
+}
+
+// CommandMetrics records how long each command took
+type CommandMetrics struct {
+	lock      sync.Mutex
+	durations map[string]time.Duration
+}
+
+func (m *CommandMetrics) CommandSeen(verb string, dur time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.durations[verb] = dur
+}
+
+func (m *CommandMetrics) Duration(verb string) (time.Duration, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	dur, ok := m.durations[verb]
+	return dur, ok
+}
+
+func TestSMTPServerCommandMetrics(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	metrics := &CommandMetrics{durations: make(map[string]time.Duration)}
+	server.Metrics = metrics
+	server.Extend("XSLOW", &smtpd.SimpleExtension{
+		Handler: func(c *smtpd.Conn, args string) error {
+			time.Sleep(100 * time.Millisecond)
+			return c.WriteOK()
+		},
+	})
+
+	closed := make(chan struct{})
+	server.OnClose = func(*smtpd.Conn) {
+		close(closed)
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	for _, cmd := range []string{"NOOP", "XSLOW"} {
+		c.PrintfLine("%v", cmd)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("%v failed: %v", cmd, err)
+		}
+	}
+
+	c.PrintfLine("QUIT")
+	c.ReadResponse(221)
+	c.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the session to end")
+	}
+
+	if dur, ok := metrics.Duration("XSLOW"); !ok || dur < 100*time.Millisecond {
+		t.Errorf("Expected XSLOW to take at least 100ms, got: %v", dur)
+	}
+	if dur, ok := metrics.Duration("NOOP"); !ok || dur >= 100*time.Millisecond {
+		t.Errorf("Expected NOOP to be quick, got: %v", dur)
+	}
+	if _, ok := metrics.Duration("QUIT"); !ok {
+		t.Error("Expected the final command to be timed too")
+	}
+}
+
+func TestSMTPServerRequireResolvableSender(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.RequireResolvableSender = true
+	server.Resolver = &FakeResolver{
+		MXs:   map[string][]*net.MX{"mx.example.org": {{Host: "mail.example.org.", Pref: 10}}},
+		Hosts: map[string][]string{"a.example.org": {"192.0.2.1"}},
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Expected a greeting: %v", err)
+	}
+
+	c.PrintfLine("MAIL FROM:<sender@nowhere.example.org>")
+	if _, msg, err := c.ReadResponse(450); err != nil {
+		t.Errorf("Expected an unresolvable sender domain to be deferred: %v", err)
+	} else if msg != "Sender domain must resolve" {
+		t.Errorf("Wrong rejection, got: %v", msg)
+	}
+
+	for _, from := range []string{"sender@mx.example.org", "sender@a.example.org", ""} {
+		c.PrintfLine("MAIL FROM:<%v>", from)
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Errorf("Expected MAIL FROM:<%v> to be accepted: %v", from, err)
+		}
+		c.PrintfLine("RSET")
+		if _, _, err := c.ReadResponse(250); err != nil {
+			t.Fatalf("RSET failed: %v", err)
+		}
+	}
+}
+
+func TestSMTPServerMessageWarnings(t *testing.T) {
+
+	var warnings []string
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		if _, err := msg.Parts(); err != nil {
+			return err
+		}
+		warnings = msg.Warnings()
+		return nil
+	})
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := "From: sender@example.org\n" +
+		"To: recipient@example.net\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"parts\"\n\n" +
+		"--parts\n" +
+		"Content-Type: text/plain; charset=x-unknown\n\n" +
+		"hello\n" +
+		"--parts--\n"
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("A part in an unknown charset shouldn't stop delivery: %v", err)
+	}
+
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "x-unknown") {
+		t.Errorf("Expected a warning about the x-unknown charset, got: %v", warnings)
+	}
+}
+
+// WriteTestingKeypair writes the testing keypair out so it can be loaded with UseTLS
+func WriteTestingKeypair(t *testing.T) (certFile, keyFile string) {
+	dir := t.TempDir()
+	cert := TestingTLSConfig().Certificates[0]
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestSMTPServerHostnameAfterUseTLS(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	certFile, keyFile := WriteTestingKeypair(t)
+	if err := server.UseTLS(certFile, keyFile); err != nil {
+		t.Fatalf("Should be able to load the TLS keypair: %v", err)
+	}
+
+	// configured the other way round, the name still has to reach the handshake
+	server.Hostname = "mx2.example.com"
+
+	config, err := server.TLSConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("Expected a config for the handshake: %v", err)
+	}
+	if config.ServerName != "mx2.example.com" {
+		t.Errorf("Wrong TLS ServerName, want: mx2.example.com, got: %v", config.ServerName)
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := smtp.Dial(server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Errorf("Should be able to negotiate some TLS? %v", err)
+	}
+}
+
+func TestSMTPServerHostname(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.Hostname = "mx1.example.com"
+
+	certFile, keyFile := WriteTestingKeypair(t)
+	if err := server.UseTLS(certFile, keyFile); err != nil {
+		t.Fatalf("Should be able to load the TLS keypair: %v", err)
+	}
+
+	if server.TLSConfig.ServerName != "mx1.example.com" {
+		t.Errorf("Wrong TLS ServerName, want: mx1.example.com, got: %v", server.TLSConfig.ServerName)
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	_, banner, err := conn.ReadResponse(220)
+	if err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	if !strings.HasPrefix(banner, "mx1.example.com ") {
+		t.Errorf("Expected the banner to start with the hostname, got: %v", banner)
+	}
+
+	conn.PrintfLine("EHLO client.example.net")
+	_, ehlo, err := conn.ReadResponse(250)
+	if err != nil {
+		t.Fatalf("EHLO failed: %v", err)
+	}
+	if !strings.HasPrefix(ehlo, "mx1.example.com ") {
+		t.Errorf("Expected the EHLO greeting to start with the hostname, got: %v", ehlo)
+	}
+}
+
+func TestSMTPServerDataSink(t *testing.T) {
+
+	var body bytes.Buffer
+	for body.Len() < 3<<20 {
+		fmt.Fprintf(&body, "%08d the quick brown fox jumps over the lazy dog\n.%v\n", body.Len(), body.Len())
+	}
+	content := strings.TrimSuffix(body.String(), "\n")
+	header := "From: sender@example.org\nTo: recipient@example.net\nSubject: Streamed\n\n"
+
+	var sinks []string
+	var streamed []byte
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		if len(msg.RawBody) != 0 {
+			t.Errorf("Expected the body to stay in the sink, got %v bytes in memory", len(msg.RawBody))
+		}
+		r, err := msg.BodyReader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		streamed, err = ioutil.ReadAll(r)
+		return err
+	})
+	server.MaxSize = 8 << 20
+
+	dir := t.TempDir()
+	server.DataSink = func(conn *smtpd.Conn) (io.WriteCloser, error) {
+		f, err := ioutil.TempFile(dir, "message")
+		if err == nil {
+			sinks = append(sinks, f.Name())
+		}
+		return f, err
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, header+content); err != nil {
+		t.Fatalf("Should be able to stream the message: %v", err)
+	}
+
+	if len(sinks) != 1 {
+		t.Fatalf("Expected 1 sink, got: %v", len(sinks))
+	}
+
+	written, err := ioutil.ReadFile(sinks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, []byte(header+content)) {
+		t.Errorf("Sink content differs from what was sent, %v bytes vs %v", len(written), len(header+content))
+	}
+
+	if !bytes.Equal(streamed, []byte(content)) {
+		t.Errorf("Handler read back the wrong body, %v bytes vs %v", len(streamed), len(content))
+	}
+}
+
+func TestSMTPServerMessageRemoteAddr(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: hello\n\nhello"); err != nil {
+		t.Fatalf("Should be able to send the message: %v", err)
+	}
+
+	if len(recorder.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got: %v", len(recorder.Messages))
+	}
+	msg := recorder.Messages[0]
+
+	addr, ok := msg.RemoteAddr.(*net.TCPAddr)
+	if !ok || !addr.IP.IsLoopback() {
+		t.Errorf("Expected the message to come from a loopback address, got: %v", msg.RemoteAddr)
+	}
+
+	// net/smtp says hello as localhost by default
+	if msg.HeloHost != "localhost" {
+		t.Errorf("Wrong HELO host, want: localhost, got: %v", msg.HeloHost)
+	}
+}
+
+func TestSMTPServerCorruptAttachmentLimit(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxAttachmentBytes = 10
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	body := `From: sender@example.org
+To: recipient@example.net
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="corrupt"
+
+--corrupt
+Content-Type: text/plain
+
+hello
+--corrupt
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename="corrupt.bin"
+
+!!!!****
+--corrupt--
+`
+
+	// the attachments can't be measured, so the message is left for the handler
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, body); err != nil {
+		t.Fatalf("Should be able to send the message: %v", err)
+	}
+
+	if _, err := recorder.Messages[0].Attachments(); err == nil {
+		t.Error("Expected an error finding attachments in a corrupt message")
+	}
+
+	// and the server is still up
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: again\n\nhello"); err != nil {
+		t.Fatalf("Server should survive a corrupt attachment: %v", err)
+	}
+}
+
+func TestSMTPServerLongCommandLine(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxSize = 1024
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+
+	conn.PrintfLine("NOOP %v", strings.Repeat("x", 8<<20))
+	if code, msg, err := conn.ReadResponse(500); err != nil {
+		t.Errorf("Expected an over-long line to be refused, got: %v %v", code, msg)
+	}
+
+	// the session carries on in sync after the long line
+	conn.PrintfLine("NOOP")
+	if code, msg, err := conn.ReadResponse(250); err != nil {
+		t.Errorf("Expected NOOP to succeed, got: %v %v", code, msg)
+	}
+}
+
+func TestSMTPServerRefusedBDATChunk(t *testing.T) {
+
+	for name, configure := range map[string]func(*smtpd.Server){
+		"auth required": func(server *smtpd.Server) {
+			server.Auth = smtpd.NewAuth()
+		},
+		"disabled": func(server *smtpd.Server) {
+			server.Disabled["BDAT"] = true
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := &MessageRecorder{}
+			server := smtpd.NewServer(recorder.Record)
+			configure(server)
+
+			go server.ListenAndServe("localhost:0")
+			defer server.Close()
+
+			WaitUntilAlive(server)
+
+			conn, err := net.Dial("tcp", server.Address())
+			if err != nil {
+				t.Fatalf("Should be able to dial localhost: %v", err)
+			}
+			defer conn.Close()
+
+			c := textproto.NewConn(conn)
+			if _, _, err := c.ReadResponse(220); err != nil {
+				t.Fatalf("Expected a greeting: %v", err)
+			}
+
+			// the chunk has to be skipped over, not run as commands
+			chunk := "QUIT\r\n"
+			fmt.Fprintf(conn, "BDAT %v LAST\r\n%v", len(chunk), chunk)
+			if code, _, _ := c.ReadResponse(5); code/100 != 5 {
+				t.Fatalf("Expected BDAT to be refused, got: %v", code)
+			}
+
+			c.PrintfLine("NOOP")
+			if code, msg, err := c.ReadResponse(250); err != nil {
+				t.Errorf("Expected the session to carry on, got: %v %v", code, msg)
+			}
+		})
+	}
+}
+
+func TestSMTPServerDataSinkCleanup(t *testing.T) {
+
+	server := smtpd.NewServer(func(msg *smtpd.Message) error {
+		if msg.Subject == "reject" {
+			return smtpd.NewError(554, "Rejected")
+		}
+		return nil
+	})
+	server.MaxSize = 1024
+
+	dir := t.TempDir()
+	server.DataSink = func(conn *smtpd.Conn) (io.WriteCloser, error) {
+		return ioutil.TempFile(dir, "message")
+	}
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: reject\n\nhello"); err == nil {
+		t.Error("Expected the handler to reject the message")
+	}
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: big\n\n"+strings.Repeat("x", 2048)); err == nil {
+		t.Error("Expected the message to be too big")
+	}
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	}
+	conn.PrintfLine("DATA")
+	conn.ReadResponse(0)
+	conn.PrintfLine(".")
+	conn.ReadResponse(0)
+	conn.PrintfLine("QUIT")
+	conn.ReadResponse(221)
+
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Errorf("Expected nothing left in the sink, found %v files", len(files))
+	}
+
+	if err := SendMessage(server.Address(), "sender@example.org", []string{"recipient@example.net"}, "Subject: accept\n\nhello"); err != nil {
+		t.Fatalf("Should be able to send the message: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected the accepted message to stay in the sink, found %v files", len(files))
+	}
+}
+
+func TestSMTPServerRequireTLSWithoutConfig(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.RequireTLS = true
+
+	if err := server.ListenAndServe("localhost:0"); err != smtpd.ErrTLSNotConfigured {
+		t.Errorf("Expected RequireTLS without a TLSConfig to be refused, got: %v", err)
+	}
+}
+
+func TestSMTPServerDeprecatedName(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+
+	if server.Name != server.Hostname || server.ServerName != server.Hostname {
+		t.Errorf("Expected the deprecated names to default to the hostname, got: %v & %v", server.Name, server.ServerName)
+	}
+
+	server.Name = "legacy.example.com"
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	conn, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer conn.Close()
+
+	if _, banner, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("Expected greeting: %v", err)
+	} else if !strings.HasPrefix(banner, "legacy.example.com ") {
+		t.Errorf("Expected the banner to use the deprecated Name, got: %v", banner)
+	}
+}
+
+func TestSMTPServerTinyMaxIdle(t *testing.T) {
+
+	recorder := &MessageRecorder{}
+	server := smtpd.NewServer(recorder.Record)
+	server.MaxIdle = time.Nanosecond
+
+	go server.ListenAndServe("localhost:0")
+	defer server.Close()
+
+	WaitUntilAlive(server)
+
+	c, err := textproto.Dial("tcp", server.Address())
+	if err != nil {
+		t.Fatalf("Should be able to dial localhost: %v", err)
+	}
+	defer c.Close()
+
+	// the connection is reaped rather than the server panicking, whether or not the
+	// greeting made it out first
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := c.ReadLine(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+}
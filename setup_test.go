@@ -6,10 +6,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"fmt"
 	"math/big"
 	"net"
+	"net/smtp"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/mailproto/smtpd"
 )
@@ -64,6 +67,35 @@ func TestingTLSConfig() *tls.Config {
 	return tlsConfig
 }
 
+// TestingClientCert generates a self-signed client certificate for the given common name
+func TestingClientCert(commonName string) tls.Certificate {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	xc := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	b, err := x509.CreateCertificate(rand.Reader, &xc, &xc, &priv.PublicKey, priv)
+	if err != nil {
+		panic(err)
+	}
+	leaf, err := x509.ParseCertificate(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{b}, PrivateKey: priv, Leaf: leaf}
+}
+
 // WaitUntilAlive is a helper function to allow us to not start tests until a server boots
 func WaitUntilAlive(s *smtpd.Server) {
 	if alive := <-s.Ready; !alive {
@@ -71,6 +103,38 @@ func WaitUntilAlive(s *smtpd.Server) {
 	}
 }
 
+// SendMessage is a helper to deliver a single message to the server at addr, returning
+// the first error encountered along the way (including the server's response to DATA)
+func SendMessage(addr, from string, to []string, body string) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(wc, body); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
 // TestLogger sends all log messages to the testing.T object, to be displayed as it sees fit
 type TestLogger struct {
 	t *testing.T
@@ -85,5 +149,5 @@ func (t *TestLogger) Println(v ...interface{}) {
 }
 
 func (t *TestLogger) Printf(format string, v ...interface{}) {
-	t.t.Logf(format, v)
+	t.t.Logf(format, v...)
 }
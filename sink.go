@@ -0,0 +1,91 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DataSource can be implemented by the writer a DataSink returns so the message can be read
+// back from it once it's been written & closed, and removed if the message isn't accepted.
+// An *os.File is simply reopened, or removed, by name
+type DataSource interface {
+	Open() (io.ReadCloser, error)
+	Remove() error
+}
+
+// dataSink wraps the writer from the server's DataSink, remembering why it failed, if it did
+type dataSink struct {
+	w      io.WriteCloser
+	open   func() (io.ReadCloser, error)
+	remove func() error
+	err    error
+}
+
+func (d *dataSink) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return n, err
+}
+
+func (d *dataSink) Close() error {
+	err := d.w.Close()
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return err
+}
+
+// body opens what was written to the sink, skipping the header section in front of the body
+func (d *dataSink) body(skip int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		r, err := d.open()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil && err != io.EOF {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// openDataSink gets a writer for the connection's next message from the DataSink
+func (s *Server) openDataSink(conn *Conn) (*dataSink, error) {
+	w, err := s.DataSink(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &dataSink{w: w}
+	switch source := w.(type) {
+	case DataSource:
+		sink.open, sink.remove = source.Open, source.Remove
+	case *os.File:
+		name := source.Name()
+		sink.open = func() (io.ReadCloser, error) { return os.Open(name) }
+		sink.remove = func() error { return os.Remove(name) }
+	default:
+		w.Close()
+		return nil, fmt.Errorf("%T can't be read back, it must be an *os.File or implement DataSource", w)
+	}
+	return sink, nil
+}
+
+// discardSink removes what was written to the sink, when no message came of it
+func (s *Server) discardSink(sink *dataSink) {
+	if err := sink.remove(); err != nil {
+		s.logf(LogError, "Could not remove DATA sink: %v", err)
+	}
+}
+
+// streamedBody is the body of a message that was streamed to the DataSink rather than read into memory
+type streamedBody struct {
+	sink     *dataSink
+	skip     int64
+	eightBit bool
+}